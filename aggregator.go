@@ -1,23 +1,36 @@
 // Responsible for receiving stats (on a channel), aggregating them into snapshots per time interval, and outputting data for completed intervals on the output channel.
 //
-// * At any point in time the aggregator is aggregating stats into 2 snapshots - passed & next. Passed is the last tick timestamp, which is waiting for all survey data to be reported. Stats reported without an associated timestamp go into next. The next snapshot is propagated to passed when the next tick occurs, and will be outputted when all survey data has also been received.
+// * At any point in time the aggregator is aggregating stats into 2 snapshots - passed & next. Passed is the last tick timestamp, which is waiting for all survey data to be reported. Stats reported without an associated timestamp (pushed by clients with stats_push) go into next. The next snapshot is propagated to passed when the next tick occurs, and will be outputted when all survey data has also been received.
 // * If data is received for an already report snapshop, an error is logged and the data is discarded.
+// * On shutdown, passed is output if it hasn't been already and the output channel is closed. Stats pushed since the final survey are discarded.
+// * If only some stats were requested for a timestamp (report_list), the client manager tells the aggregator which ones, and the snapshot is marked as partial by listing them in Requested. Partial snapshots are complete once every surveyed client has replied for the listed stats.
 
 package main
 
+type partialSurvey struct {
+	Timestamp int64
+	Stats     []string
+}
+
 type Aggregator struct {
-	output   chan (*TimestampedStats)
-	passed   *TimestampedStats
-	passedTs int64
-	next     *TimestampedStats
-	Stats    chan (*Stats)
+	output      chan (*TimestampedStats)
+	passed      *TimestampedStats
+	passedTs    int64
+	next        *TimestampedStats
+	Stats       chan (*Stats)
+	Push        chan (*Stats)
+	partial     chan (partialSurvey)
+	sigShutdown chan bool
 }
 
 func NewAggregator() *Aggregator {
 	return &Aggregator{
-		output: make(chan *TimestampedStats),
-		next:   NewTimestampedStats(-1),
-		Stats:  make(chan *Stats),
+		output:      make(chan *TimestampedStats),
+		next:        NewTimestampedStats(-1),
+		Stats:       make(chan *Stats),
+		Push:        make(chan *Stats),
+		partial:     make(chan partialSurvey),
+		sigShutdown: make(chan bool),
 	}
 }
 
@@ -28,12 +41,31 @@ func (self *Aggregator) Run(ts_complete <-chan (int64), ts_new <-chan (int64)) {
 			self.newInterval(ts)
 		case stats := <-self.Stats:
 			self.feed(stats)
+		case stats := <-self.Push:
+			self.add(self.next, stats)
+		case p := <-self.partial:
+			self.markPartial(p)
 		case ts := <-ts_complete:
 			self.report(ts)
+		case <-self.sigShutdown:
+			if self.passed != nil && !self.passed.Empty {
+				self.report(self.passedTs)
+			}
+			if !self.next.Empty {
+				info.Print("[aggregator] Discarding stats pushed after the final survey")
+			}
+			close(self.output)
+			return
 		}
 	}
 }
 
+// Shutdown stops the aggregator, which closes the output channel once
+// everything aggregated has been output
+func (self *Aggregator) Shutdown() {
+	self.sigShutdown <- true
+}
+
 func (self *Aggregator) newInterval(ts int64) {
 	if self.passed != nil && !self.passed.Empty {
 		self.report(self.passed.Timestamp)
@@ -44,25 +76,51 @@ func (self *Aggregator) newInterval(ts int64) {
 	self.next = NewTimestampedStats(-1)
 }
 
+// feed adds surveyed stats to passed, if they're for the passed timestamp
 func (self *Aggregator) feed(stats *Stats) {
-	if stats.Timestamp == self.passedTs {
-		for _, s := range stats.Values {
-			self.passed.AddValue(s)
-		}
-		for _, s := range stats.Counts {
-			self.passed.AddCount(s)
-		}
-		for _, s := range stats.Dists {
-			self.passed.AddDist(s)
-		}
+	if self.passed != nil && stats.Timestamp == self.passedTs {
+		self.add(self.passed, stats)
 	} else {
 		info.Printf("[aggregator] (ts:%v) Stats received for unexpected timestamp, discarding", stats.Timestamp)
 	}
 }
 
+func (self *Aggregator) add(ts *TimestampedStats, stats *Stats) {
+	for _, s := range stats.Values {
+		ts.AddValue(s)
+	}
+	for _, s := range stats.Counts {
+		ts.AddCount(s)
+	}
+	for _, s := range stats.Dists {
+		ts.AddDist(s)
+	}
+	for _, s := range stats.Histograms {
+		ts.AddHistogram(s)
+	}
+	for _, s := range stats.SegmentedValues {
+		ts.AddSegmentedValue(s)
+	}
+	for _, s := range stats.SegmentedCounts {
+		ts.AddSegmentedCount(s)
+	}
+}
+
+func (self *Aggregator) markPartial(p partialSurvey) {
+	if self.passed != nil && p.Timestamp == self.passedTs {
+		self.passed.Requested = p.Stats
+	} else {
+		info.Printf("[aggregator] (ts:%v) Partial survey for unexpected timestamp, ignoring", p.Timestamp)
+	}
+}
+
 func (self *Aggregator) report(ts int64) {
 	if ts == self.passedTs {
-		debug.Printf("[aggregator] (ts:%v) Finished aggregating data", ts)
+		if self.passed.Requested != nil {
+			debug.Printf("[aggregator] (ts:%v) Finished aggregating data for %v requested stats", ts, len(self.passed.Requested))
+		} else {
+			debug.Printf("[aggregator] (ts:%v) Finished aggregating data", ts)
+		}
 		self.output <- self.passed
 		self.passed = nil
 		self.passedTs = -1
@@ -82,6 +140,11 @@ func (self *Aggregator) Count(ts int64, name string, value Count, Type string) {
 func (self *Aggregator) Value(ts int64, name string, value float64, Type string) {
 	self.Stats <- &Stats{
 		Timestamp: ts,
-		Values:    []StatValue{StatValue{name, value, &Type}},
+		Values:    []StatValue{StatValue{Name: name, Value: value, Type: &Type}},
 	}
 }
+
+// Partial records that only the listed stats were requested for a timestamp
+func (self *Aggregator) Partial(ts int64, stats []string) {
+	self.partial <- partialSurvey{ts, stats}
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"testing"
+)
+
+func Test_AggregatorOutputsUnfinishedIntervalOnTick(t *testing.T) {
+	agg := NewAggregator()
+	ts_complete := make(chan int64)
+	ts_new := make(chan int64)
+	go agg.Run(ts_complete, ts_new)
+
+	ts_new <- 10
+	agg.Count(10, "hits", 1, "count")
+
+	// 10 hasn't completed, but has stats, so is output when 20 starts
+	ts_new <- 20
+	stats := <-agg.output
+	if stats.Timestamp != 10 || stats.Empty || stats.Counters["hits"] != 1 {
+		t.Errorf("expected interval 10 with 1 hit, got %+v", stats)
+	}
+
+	// Completing 10 afterwards is logged and ignored, and 20 is still
+	// output once complete
+	ts_complete <- 10
+	agg.Count(20, "hits", 2, "count")
+	ts_complete <- 20
+	stats = <-agg.output
+	if stats.Timestamp != 20 || stats.Counters["hits"] != 2 {
+		t.Errorf("expected interval 20 with 2 hits, got %+v", stats)
+	}
+
+	// Intervals without stats are dropped when the next one starts
+	ts_new <- 30
+	ts_new <- 40
+	ts_complete <- 40
+	if stats = <-agg.output; stats.Timestamp != 40 || !stats.Empty {
+		t.Errorf("expected empty interval 40, got %+v", stats)
+	}
+}
+
+func Test_AggregatorShutdownOutputsPassed(t *testing.T) {
+	a := NewAggregator()
+	ts_complete := make(chan int64)
+	ts_new := make(chan int64)
+	go a.Run(ts_complete, ts_new)
+
+	ts_new <- 10
+	a.Count(10, "conns", 3, "count")
+	a.Shutdown()
+
+	stats, ok := <-a.output
+	if !ok || stats.Timestamp != 10 || stats.Counters["conns"] != 3 {
+		t.Fatalf("expected the passed interval to be output, got %+v", stats)
+	}
+	if _, ok := <-a.output; ok {
+		t.Error("expected output to be closed")
+	}
+}
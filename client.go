@@ -5,6 +5,15 @@ import (
 	"fmt"
 )
 
+// Capabilities which clients may declare at registration. Requests and stat
+// types which a client hasn't declared are neither sent to nor accepted from it
+const (
+	CapReportList = "report_list"
+	CapHistograms = "histograms"
+	CapSegments   = "segments"
+	CapWeights    = "weights"
+)
+
 type StatsEnvelope struct {
 	Method    string
 	Timestamp int64
@@ -14,6 +23,12 @@ type StatsRequest struct {
 	Timestamp int64
 }
 
+// Sent by an overloaded client instead of stats
+type SkipReply struct {
+	Timestamp int64
+	Reason    string
+}
+
 type message struct {
 	Method string
 	Params map[string]interface{}
@@ -22,21 +37,30 @@ type message struct {
 type Client struct {
 	id       int
 	pc       *pair.Conn
+	meta     pair.Meta
+	interval int64 // survey interval in seconds, 0 for every tick
 	name     string
 	sendc    chan (message)
 	statsc   chan<- (*Stats)
+	pushc    chan<- (*Stats)
 	complete chan<- (CompleteMessage)
 }
 
-func NewClient(id int, pc *pair.Conn, meta string, statsc chan<- (*Stats), complete chan<- (CompleteMessage)) *Client {
-	name := fmt.Sprintf("[client:%v-%v]", id, meta)
+func NewClient(id int, pc *pair.Conn, meta pair.Meta, statsc, pushc chan<- (*Stats), complete chan<- (CompleteMessage)) *Client {
+	name := fmt.Sprintf("[client:%v]", id)
+	if m := meta.String(); m != "" {
+		name = fmt.Sprintf("[client:%v %v]", id, m)
+	}
 	sendc := make(chan message, 1)
 	return &Client{
 		id,
 		pc,
+		meta,
+		0,
 		name,
 		sendc,
 		statsc,
+		pushc,
 		complete,
 	}
 }
@@ -45,13 +69,51 @@ func (c *Client) Id() int {
 	return c.id
 }
 
+// Name identifies the client in logs, including any registration metadata
+func (c *Client) Name() string {
+	return c.name
+}
+
+func (c *Client) Meta() pair.Meta {
+	return c.meta
+}
+
+// Version is the protocol version declared by the client at registration
+func (c *Client) Version() int {
+	return c.meta.Version
+}
+
+func (c *Client) Supports(capability string) bool {
+	return c.meta.Supports(capability)
+}
+
+// SetInterval sets how often the client is surveyed, in seconds
+func (c *Client) SetInterval(interval int64) {
+	c.interval = interval
+}
+
+// DueAt returns whether the client should be surveyed for a timestamp. Ticks
+// are anchored at multiples of the base interval, so a client is due whenever
+// the timestamp is a multiple of its own interval
+func (c *Client) DueAt(ts int64) bool {
+	return c.interval == 0 || ts%c.interval == 0
+}
+
 func (c *Client) Send(m string, p map[string]interface{}) {
 	c.sendc <- message{m, p}
 }
 
-func (c *Client) RequestStats(ts int64) {
+// RequestStats asks the client to report stats for the given timestamp. A nil
+// list requests all stats, otherwise only the listed stats are requested.
+// Clients which don't support report_list are asked for all stats, although
+// the ClientManager only requests a list when every surveyed client supports it.
+func (c *Client) RequestStats(ts int64, stats []string) {
 	// TODO: Make Timestamp lowercase
-	c.Send("report_all", map[string]interface{}{"Timestamp": ts})
+	if stats == nil || !c.Supports(CapReportList) {
+		c.Send("report_all", map[string]interface{}{"Timestamp": ts})
+	} else {
+		c.Send("report_list", map[string]interface{}{"Timestamp": ts, "Stats": stats})
+	}
 }
 
 func (c *Client) Run(clientDidClose chan<- int) {
@@ -59,6 +121,7 @@ func (c *Client) Run(clientDidClose chan<- int) {
 		var stats Stats
 		if err = unmarshal(data, &stats); err == nil {
 			ts = stats.Timestamp
+			c.discardUnsupported(&stats)
 			c.statsc <- &stats
 		} else {
 			info.Printf("Error decoding msgpack data: %v", data)
@@ -87,7 +150,23 @@ func (c *Client) Run(clientDidClose chan<- int) {
 				if ts, err = handleStats(m.Params); err != nil {
 					info.Printf("Error decoding stats_complete: %v", err)
 				} else {
-					c.complete <- CompleteMessage{c.Id(), ts}
+					c.complete <- CompleteMessage{c.Id(), ts, false}
+				}
+			case "stats_push":
+				var stats Stats
+				if err = unmarshal(m.Params, &stats); err != nil {
+					info.Printf("Error decoding stats_push: %v", err)
+				} else {
+					c.discardUnsupported(&stats)
+					c.pushc <- &stats
+				}
+			case "skipping":
+				var skip SkipReply
+				if err = unmarshal(m.Params, &skip); err != nil {
+					info.Printf("Error decoding skipping: %v", err)
+				} else {
+					info.Printf("%v (ts:%v) Skipping survey: %v", c.name, skip.Timestamp, skip.Reason)
+					c.complete <- CompleteMessage{c.Id(), skip.Timestamp, true}
 				}
 			default:
 				info.Printf("Received unknown command %v", m.Method)
@@ -98,3 +177,22 @@ func (c *Client) Run(clientDidClose chan<- int) {
 		}
 	}
 }
+
+// discardUnsupported drops stat types which the client didn't declare support
+// for, since they can't have been sent intentionally
+func (c *Client) discardUnsupported(stats *Stats) {
+	if len(stats.Histograms) > 0 && !c.Supports(CapHistograms) {
+		info.Printf("%v Discarding %v histograms, capability not declared", c.name, len(stats.Histograms))
+		stats.Histograms = nil
+	}
+	if (len(stats.SegmentedValues) > 0 || len(stats.SegmentedCounts) > 0) && !c.Supports(CapSegments) {
+		info.Printf("%v Discarding %v segmented stats, capability not declared", c.name, len(stats.SegmentedValues)+len(stats.SegmentedCounts))
+		stats.SegmentedValues = nil
+		stats.SegmentedCounts = nil
+	}
+	if !c.Supports(CapWeights) {
+		for i := range stats.Values {
+			stats.Values[i].Weight = 0
+		}
+	}
+}
@@ -1,40 +1,107 @@
 // Each client is given a unique reference by the client manager. When stats are requested the client manager must make a record of all the clients for which the request was sent to, since it expects to get a reply from each one of them (which may be a different set from the current set of clients if a new client has just been registered).
 //
-// A set of clients is created for a given timestamp when the stats are requested. When a client goes away or a client has finished reporting all stats it is removed from this set. When the set is empty, or after a timeout (tbd) the aggregator is notified to say that a given timestamp should be considered complete. Any more stats for that timestamp arriving in the aggregator should then be thrown away.
+// Clients may ask at registration to be surveyed less often than every tick. Their interval is rounded up to a multiple of the base interval, and on each tick only the clients which are due are surveyed. If no clients are due the timestamp is completed straight away, so that a snapshot is still output for every base interval.
+//
+// Which stats are requested on a given tick is decided by the survey schedule. Ticks where only some stats are requested use report_list instead of report_all, unless a client due to be surveyed doesn't support report_list, in which case all stats are requested from every client so that the interval isn't a mix of both. The aggregator is told which stats were requested, so that it can mark the interval as partial.
+//
+// A set of clients is created for a given timestamp when the stats are requested. When a client goes away, has finished reporting all stats, or replies that it is skipping the survey it is removed from this set. When the set is empty, or after a timeout (tbd) the aggregator is notified to say that a given timestamp should be considered complete. Any more stats for that timestamp arriving in the aggregator should then be thrown away.
+//
+// On shutdown no more ticks are surveyed. Once any outstanding survey has completed (or timed out), a final survey of every client for all stats is run, so that stats since the last tick aren't lost. Clients are still added and removed by the pair server until it has shut down, which the client manager ignores until closed.
 
 package main
 
 import (
 	"./pair"
+	"sort"
+	"strings"
 	"time"
 )
 
-// Sent by clients when they have finished receiving data for a timestamp
+// Sent by clients when they have finished receiving data for a timestamp, or
+// when they have replied that they are skipping it
 type CompleteMessage struct {
 	ClientId  int
 	Timestamp int64
+	Skipped   bool
+}
+
+// An outstanding survey for a timestamp
+type survey struct {
+	waiting map[int]string // names of clients yet to reply, by id
+}
+
+// Survey settings which can be changed while running
+type surveyConfig struct {
+	schedule SurveySchedule
+	interval int64
+	timeout  int
+}
+
+// A client which re-registered from the same address as an existing one
+type clientReplacement struct {
+	old, new *Client
 }
 
 type ClientManager struct {
 	add_client_c chan (*Client)
 	rem_client_c chan (*Client)
+	rep_client_c chan (clientReplacement)
+	reconfigure  chan (surveyConfig)
 	onComplete   chan (CompleteMessage)
 	agg          *Aggregator
+	schedule     SurveySchedule
+	interval     int64 // base survey interval in seconds
+	sigShutdown  chan bool
+	didShutdown  chan bool
+	sigClose     chan bool
 }
 
-func NewClientManager(a *Aggregator) *ClientManager {
+func NewClientManager(a *Aggregator, schedule SurveySchedule, interval int) *ClientManager {
 	return &ClientManager{
 		make(chan (*Client)),
 		make(chan (*Client)),
+		make(chan (clientReplacement)),
+		make(chan (surveyConfig)),
 		make(chan CompleteMessage),
 		a,
+		schedule,
+		int64(interval),
+		make(chan bool),
+		make(chan bool),
+		make(chan bool),
 	}
 }
 
-func (self *ClientManager) Run(ticker <-chan (time.Time), timeout int, ts_complete, ts_new chan<- (int64)) {
+// clientInterval rounds the interval requested by a client up to a multiple of
+// the base interval. Intervals no longer than the base interval survey the
+// client on every tick
+func (self *ClientManager) clientInterval(c *Client) int64 {
+	requested := int64(c.Meta().Interval)
+	if requested <= self.interval {
+		return 0
+	}
+	rounded := (requested + self.interval - 1) / self.interval * self.interval
+	if rounded != requested {
+		info.Printf("[cm] %v requested interval %vs, rounding to %vs", c.Name(), requested, rounded)
+	}
+	return rounded
+}
+
+func (self *ClientManager) Run(timeout int, ts_complete, ts_new chan<- (int64)) {
 	clients := make(map[int]*Client)
 
-	outstanding_stats := map[int64]int{}
+	// Ticks every base interval, replaced when the interval is reconfigured
+	stop_ticker := make(chan bool)
+	ticker := NewTicker(int(self.interval), stop_ticker)
+	defer func() { close(stop_ticker) }()
+
+	outstanding_stats := map[int64]*survey{}
+
+	// Number of ticks seen, used to decide which stats are due
+	tick := 0
+
+	// Number of clients replaced by re-registration since the last tick
+	replaced := 0
 
 	// Stores the nanosecond time at which a timestamp was emitted, which may
 	// be a few ms after the second. This is used to calculate a more precise
@@ -45,75 +112,274 @@ func (self *ClientManager) Run(ticker <-chan (time.Time), timeout int, ts_comple
 	on_timeout := make(chan int64)
 
 	// Avoid allocations
-	var ts, tsn int64
+	var ts, tsn, last_ts int64
 	var now time.Time
 	var latency float64
+	var due bool
+	var stats []string
+	var surveyed []*Client
+
+	// Set once shutdown is requested, and once the final survey has started
+	var shutting_down, final_surveyed bool
+
+	// startSurvey requests stats for a new timestamp from the clients which
+	// are due, or from every client for all stats if final
+	startSurvey := func(now time.Time, final bool) {
+		ts = now.Unix()
+		if ts <= last_ts {
+			// Only when shutting down within a second of a tick
+			ts = last_ts + 1
+		}
+		last_ts = ts
+		ts_new <- ts
+		if replaced > 0 {
+			self.agg.Count(ts, "stagger.reregistrations", Count(replaced), "count")
+			replaced = 0
+		}
+
+		surveyed = surveyed[:0]
+		if final {
+			due, stats = true, nil
+		} else {
+			due, stats = self.schedule.Due(tick)
+			tick += 1
+		}
+		if due {
+			for _, client := range clients {
+				if final || client.DueAt(ts) {
+					surveyed = append(surveyed, client)
+					if stats != nil && !client.Supports(CapReportList) {
+						debug.Printf("[cm] (ts:%v) %v doesn't support report_list, requesting all stats", ts, client.Name())
+						stats = nil
+					}
+				}
+			}
+		}
+
+		if len(clients) == 0 {
+			info.Printf("[cm] (ts:%v) No clients connected to survey", ts)
+			if final {
+				// Output anything pushed since the last tick
+				ts_complete <- ts
+			}
+		} else if len(surveyed) == 0 {
+			debug.Printf("[cm] (ts:%v) No clients due to be surveyed", ts)
+			// Record metric for number registered clients
+			self.agg.Count(ts, "stagger.clients", Count(len(clients)), "count")
+			ts_complete <- ts
+		} else {
+			nanoTs[ts] = now.UnixNano()
+			if stats == nil {
+				info.Printf("[cm] (ts:%v) Surveying %v of %v clients", ts, len(surveyed), len(clients))
+			} else {
+				info.Printf("[cm] (ts:%v) Surveying %v of %v clients for %v stats", ts, len(surveyed), len(clients), len(stats))
+				self.agg.Partial(ts, stats)
+			}
+
+			// Store clients for this timestamp
+			outstanding_stats[ts] = &survey{make(map[int]string)}
+
+			// Record metric for number registered clients
+			self.agg.Count(ts, "stagger.clients", Count(len(clients)), "count")
+
+			for _, client := range surveyed {
+				outstanding_stats[ts].waiting[client.Id()] = client.Name()
+				client.RequestStats(ts, stats)
+			}
+
+			// Setup timeout to receive all the data
+			go func(ts int64, timeout time.Duration) {
+				<-time.After(timeout)
+				on_timeout <- ts
+			}(ts, time.Duration(timeout)*time.Millisecond)
+		}
+	}
+
+	// shutdownDone starts the final survey once shutting down and no surveys
+	// are outstanding, and returns true once it has completed
+	shutdownDone := func() bool {
+		if !shutting_down || len(outstanding_stats) > 0 {
+			return false
+		}
+		if final_surveyed {
+			return true
+		}
+		final_surveyed = true
+		info.Printf("[cm] Running final survey")
+		startSurvey(time.Now(), true)
+		return len(outstanding_stats) == 0
+	}
+
+	// completeSurvey notifies the aggregator that a timestamp is complete, and
+	// returns true once shutdown has completed
+	completeSurvey := func(ts int64) bool {
+		delete(outstanding_stats, ts)
+		delete(nanoTs, ts)
+		ts_complete <- ts
+		return shutdownDone()
+	}
+
+	// clientGone stops waiting for a client which was removed or replaced,
+	// completing any survey which was only waiting for it. Returns true once
+	// shutdown has completed
+	clientGone := func(id int) bool {
+		done := false
+		for ts, s := range outstanding_stats {
+			if _, ok := s.waiting[id]; !ok {
+				continue
+			}
+			delete(s.waiting, id)
+			if len(s.waiting) == 0 {
+				debug.Printf("[cm] (ts:%v) Survey complete, last client gone", ts)
+				done = completeSurvey(ts) || done
+			}
+		}
+		return done
+	}
+
+	// drain runs after the final survey, until Close. The pair server may
+	// still add, remove or replace clients until it has shut down, and late
+	// replies may still arrive, so these are read and ignored
+	drain := func() {
+		for {
+			select {
+			case <-self.add_client_c:
+			case <-self.rem_client_c:
+			case <-self.rep_client_c:
+			case <-self.reconfigure:
+			case <-self.onComplete:
+			case <-on_timeout:
+			case <-self.sigClose:
+				return
+			}
+		}
+	}
 
 	for {
 		select {
 		case client := <-self.add_client_c:
+			client.SetInterval(self.clientInterval(client))
 			clients[client.Id()] = client
-			info.Printf("[cm] Added client id:%v (count: %v)", client.Id(), len(clients))
+			info.Printf("[cm] Added client %v, protocol v%v %v (count: %v)", client.Name(), client.Version(), client.Meta().Capabilities, len(clients))
 
 		case client := <-self.rem_client_c:
 			delete(clients, client.Id())
-			info.Printf("[cm] Removed client id:%v (count: %v)", client.Id(), len(clients))
-
-		case now = <-ticker:
-			ts = now.Unix()
-			nanoTs[ts] = now.UnixNano()
-			ts_new <- ts
-			if len(clients) > 0 {
-				info.Printf("[cm] (ts:%v) Surveying %v clients", ts, len(clients))
+			info.Printf("[cm] Removed client %v (count: %v)", client.Name(), len(clients))
+			if clientGone(client.Id()) {
+				self.didShutdown <- true
+				drain()
+				return
+			}
 
-				// Store number of clients for this stat
-				outstanding_stats[ts] = len(clients)
+		case r := <-self.rep_client_c:
+			delete(clients, r.old.Id())
+			r.new.SetInterval(self.clientInterval(r.new))
+			clients[r.new.Id()] = r.new
+			replaced += 1
+			info.Printf("[cm] Replaced client %v with %v (count: %v)", r.old.Name(), r.new.Name(), len(clients))
+			if clientGone(r.old.Id()) {
+				self.didShutdown <- true
+				drain()
+				return
+			}
 
-				// Record metric for number registered clients
-				self.agg.Count(ts, "stagger.clients", Count(len(clients)),"count")
+		case now = <-ticker:
+			if shutting_down {
+				continue
+			}
+			startSurvey(now, false)
 
+		case s := <-self.reconfigure:
+			self.schedule = s.schedule
+			tick = 0
+			timeout = s.timeout
+			if s.interval != self.interval {
+				info.Printf("[cm] Changing interval from %vs to %vs", self.interval, s.interval)
+				close(stop_ticker)
+				stop_ticker = make(chan bool)
+				self.interval = s.interval
+				ticker = NewTicker(int(self.interval), stop_ticker)
 				for _, client := range clients {
-					client.RequestStats(ts)
+					client.SetInterval(self.clientInterval(client))
 				}
+			}
 
-				// Setup timeout to receive all the data
-				go func(ts int64) {
-					<-time.After(time.Duration(timeout) * time.Millisecond)
-					on_timeout <- ts
-				}(ts)
-			} else {
-				info.Printf("[cm] (ts:%v) No clients connected to survey", ts)
+		case <-self.sigShutdown:
+			shutting_down = true
+			if len(outstanding_stats) > 0 {
+				info.Printf("[cm] Shutting down, waiting for %v outstanding surveys", len(outstanding_stats))
+			}
+			if shutdownDone() {
+				self.didShutdown <- true
+				drain()
+				return
 			}
 
 		case ts = <-on_timeout:
-			if remaining, ok := outstanding_stats[ts]; ok {
-				info.Printf("[cm] (ts:%v) Survey timed out, %v clients yet to report", ts, remaining)
-				self.agg.Count(ts, "stagger.timeouts", Count(remaining), "count")
-				delete(outstanding_stats, ts)
-				delete(nanoTs, ts)
-				ts_complete <- ts // TODO: Notify that it wasn't clean
+			if s, ok := outstanding_stats[ts]; ok {
+				names := make([]string, 0, len(s.waiting))
+				for _, name := range s.waiting {
+					names = append(names, name)
+				}
+				sort.Strings(names)
+				info.Printf("[cm] (ts:%v) Survey timed out, %v clients yet to report: %v", ts, len(s.waiting), strings.Join(names, ", "))
+				self.agg.Count(ts, "stagger.timeouts", Count(len(s.waiting)), "count")
+				// TODO: Notify that it wasn't clean
+				if completeSurvey(ts) {
+					self.didShutdown <- true
+					drain()
+					return
+				}
 			}
 
 		case c := <-self.onComplete:
 			ts = c.Timestamp
 			tsn = nanoTs[ts]
-			if _, ok := outstanding_stats[ts]; ok {
-				outstanding_stats[ts] -= 1
+			if s, ok := outstanding_stats[ts]; ok {
+				delete(s.waiting, c.ClientId)
 
-				// Record the time for this client to complete survey in ms
-				latency = float64(time.Now().UnixNano()-tsn) / 1000000
-				self.agg.Value(ts, "stagger.survey_latency", latency, "ms")
+				if c.Skipped {
+					self.agg.Count(ts, "stagger.skips", 1, "count")
+				} else {
+					// Record the time for this client to complete survey in ms
+					latency = float64(time.Now().UnixNano()-tsn) / 1000000
+					self.agg.Value(ts, "stagger.survey_latency", latency, "ms")
+				}
 
-				if outstanding_stats[ts] == 0 {
-					delete(outstanding_stats, ts)
-					delete(nanoTs, ts)
-					ts_complete <- ts
+				if len(s.waiting) == 0 {
+					if completeSurvey(ts) {
+						self.didShutdown <- true
+						drain()
+						return
+					}
 				}
 			}
 		}
 	}
 }
 
+// Reconfigure changes the survey schedule, base interval (in seconds) and
+// survey timeout (in ms) of a running ClientManager. A new interval takes
+// effect from its next boundary, and surveys already started keep their
+// timeout
+func (self *ClientManager) Reconfigure(schedule SurveySchedule, interval, timeout int) {
+	self.reconfigure <- surveyConfig{schedule, int64(interval), timeout}
+}
+
+// Shutdown stops surveying on ticks, finishes any outstanding survey, runs a
+// final survey and returns once it has completed or timed out. Clients should
+// still be connected when it's called, and Close called once they aren't
+func (self *ClientManager) Shutdown() {
+	self.sigShutdown <- true
+	<-self.didShutdown
+}
+
+// Close stops the ClientManager after Shutdown, once the pair server has shut
+// down and so will no longer add or remove clients
+func (self *ClientManager) Close() {
+	self.sigClose <- true
+}
+
 func (self *ClientManager) AddClient(client interface{}) {
 	self.add_client_c <- client.(*Client)
 }
@@ -122,6 +388,10 @@ func (self *ClientManager) RemoveClient(client interface{}) {
 	self.rem_client_c <- client.(*Client)
 }
 
-func (self *ClientManager) NewClient(id int, pc *pair.Conn) pair.Pairable {
-	return pair.Pairable(NewClient(id, pc, "", self.agg.Stats, self.onComplete))
+func (self *ClientManager) ReplaceClient(old, new interface{}) {
+	self.rep_client_c <- clientReplacement{old.(*Client), new.(*Client)}
+}
+
+func (self *ClientManager) NewClient(id int, pc *pair.Conn, meta pair.Meta) pair.Pairable {
+	return pair.Pairable(NewClient(id, pc, meta, self.agg.Stats, self.agg.Push, self.onComplete))
 }
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"./pair"
+	"testing"
+	"time"
+)
+
+func Test_ClientManagerDrainsAfterShutdown(t *testing.T) {
+	agg := NewAggregator()
+	ts_complete := make(chan int64)
+	ts_new := make(chan int64)
+	go agg.Run(ts_complete, ts_new)
+	go func() {
+		for range agg.output {
+		}
+	}()
+
+	cm := NewClientManager(agg, nil, 3600)
+	go cm.Run(100, ts_complete, ts_new)
+	cm.Shutdown()
+
+	// The pair server may still add or remove clients before it shuts down
+	done := make(chan bool)
+	go func() {
+		cm.AddClient(&Client{})
+		cm.RemoveClient(&Client{})
+		cm.Close()
+		done <- true
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("expected clients to be accepted after shutdown")
+	}
+}
+
+func Test_ClientManagerStopsWaitingForReplacedClient(t *testing.T) {
+	agg := NewAggregator()
+	ts_complete := make(chan int64)
+	ts_new := make(chan int64)
+	go agg.Run(ts_complete, ts_new)
+	go func() {
+		for range agg.output {
+		}
+	}()
+
+	cm := NewClientManager(agg, nil, 3600)
+	go cm.Run(10000, ts_complete, ts_new)
+	old := &Client{id: 1, name: "[client:1]", sendc: make(chan message, 1)}
+	cm.AddClient(old)
+
+	done := make(chan bool)
+	go func() {
+		cm.Shutdown()
+		done <- true
+	}()
+
+	// Wait for the final survey to be requested, then replace the client
+	<-old.sendc
+	cm.ReplaceClient(old, &Client{id: 2, name: "[client:2]", sendc: make(chan message, 1)})
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("expected the survey to complete once the client was replaced")
+	}
+	cm.Close()
+}
+
+func Test_ClientManagerRequestsAllStatsFromLegacyClients(t *testing.T) {
+	agg := NewAggregator()
+	ts_complete := make(chan int64)
+	ts_new := make(chan int64)
+	go agg.Run(ts_complete, ts_new)
+	go func() {
+		for range agg.output {
+		}
+	}()
+
+	schedule, _ := ParseSurveySchedule("1:conns")
+	cm := NewClientManager(agg, schedule, 1)
+	go cm.Run(100, ts_complete, ts_new)
+	legacy := &Client{id: 1, name: "[client:1]", sendc: make(chan message, 1)}
+	modern := &Client{id: 2, name: "[client:2]", sendc: make(chan message, 1), meta: pair.Meta{Capabilities: []string{CapReportList}}}
+	cm.AddClient(legacy)
+	cm.AddClient(modern)
+
+	// Neither is asked for the list, so the interval isn't a mix of both
+	for _, c := range []*Client{legacy, modern} {
+		select {
+		case m := <-c.sendc:
+			if m.Method != "report_all" {
+				t.Errorf("expected %v to be sent report_all, got %v", c.Name(), m.Method)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatalf("expected %v to be surveyed", c.Name())
+		}
+	}
+	cm.Shutdown()
+	cm.Close()
+}
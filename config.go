@@ -0,0 +1,219 @@
+// Config holds everything which can be set by flags, and can also be read from a YAML config file (-config). Settings given on the command line take precedence over the file, which takes precedence over the defaults.
+//
+// Each outputter has its own section of the file. The librato, graphite and influxdb sections may set their own source, which defaults to the top level one.
+//
+// The survey settings (interval, timeout and survey), source, outputters, log_output and the HTTP features (http.features and http.ws_backlog) are reloaded on SIGHUP; changes to any other setting require a restart.
+
+package main
+
+import (
+	"flag"
+	"io/ioutil"
+	"os"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+type LibratoConfig struct {
+	Email  string `yaml:"email"`
+	Token  string `yaml:"token"`
+	Source string `yaml:"source"`
+}
+
+type GraphiteConfig struct {
+	Addr   string `yaml:"addr"`
+	Prefix string `yaml:"prefix"`
+	Source string `yaml:"source"`
+}
+
+type InfluxDBConfig struct {
+	URL    string `yaml:"url"`
+	Source string `yaml:"source"`
+}
+
+type FileConfig struct {
+	Path    string        `yaml:"path"`
+	MaxSize int64         `yaml:"max_size"` // MB
+	MaxAge  time.Duration `yaml:"max_age"`
+	Gzip    bool          `yaml:"gzip"`
+	Keep    int           `yaml:"keep"`
+}
+
+type HistoryConfig struct {
+	Dir  string        `yaml:"dir"`
+	Raw  time.Duration `yaml:"raw"`
+	OneM time.Duration `yaml:"1m"`
+	OneH time.Duration `yaml:"1h"`
+	OneD time.Duration `yaml:"1d"`
+}
+
+type PubConfig struct {
+	Addr string `yaml:"addr"`
+}
+
+type HTTPConfig struct {
+	Addr      string `yaml:"addr"`
+	HTTPSAddr string `yaml:"https_addr"`
+	Features  string `yaml:"features"`
+	WSBacklog int    `yaml:"ws_backlog"`
+	Crt       string `yaml:"crt"`
+	Key       string `yaml:"key"`
+	CA        string `yaml:"ca"`
+}
+
+type Config struct {
+	Source          string `yaml:"source"`
+	Interval        int    `yaml:"interval"`
+	Timeout         int    `yaml:"timeout"`
+	Survey          string `yaml:"survey"`
+	Registration    string `yaml:"registration"`
+	Transport       string `yaml:"transport"`
+	Heartbeat       int    `yaml:"heartbeat"`
+	HeartbeatMissed int    `yaml:"heartbeat_missed"`
+	Relay           string `yaml:"relay"`
+	RelayTimeout    int    `yaml:"relay_timeout"`
+	StatsD          string `yaml:"statsd"`
+	LogOutput       bool   `yaml:"log_output"`
+	ShutdownTimeout int    `yaml:"shutdown_timeout"`
+
+	Librato  LibratoConfig  `yaml:"librato"`
+	Graphite GraphiteConfig `yaml:"graphite"`
+	InfluxDB InfluxDBConfig `yaml:"influxdb"`
+	File     FileConfig     `yaml:"file"`
+	History  HistoryConfig  `yaml:"history"`
+	Pub      PubConfig      `yaml:"pub"`
+	HTTP     HTTPConfig     `yaml:"http"`
+}
+
+func DefaultConfig() *Config {
+	hostname, _ := os.Hostname()
+	return &Config{
+		Source:          hostname,
+		Interval:        10,
+		Timeout:         1000,
+		Registration:    "tcp://127.0.0.1:5867",
+		Transport:       "zmq",
+		Heartbeat:       2000,
+		HeartbeatMissed: 3,
+		RelayTimeout:    5000,
+		LogOutput:       true,
+		ShutdownTimeout: 5000,
+		Graphite:        GraphiteConfig{Prefix: "stagger.{source}"},
+		File:            FileConfig{MaxSize: 100, MaxAge: 24 * time.Hour, Gzip: true, Keep: 7},
+		History:         HistoryConfig{Raw: 6 * time.Hour, OneM: 7 * 24 * time.Hour, OneH: 90 * 24 * time.Hour, OneD: 5 * 365 * 24 * time.Hour},
+		Pub:             PubConfig{Addr: "tcp://*:5563"},
+		HTTP: HTTPConfig{
+			Addr:      "127.0.0.1:8990",
+			HTTPSAddr: "0.0.0.0:8443",
+			Features:  "ws-json,http-json,history-json,sparkline",
+			WSBacklog: 60,
+		},
+	}
+}
+
+// RegisterFlags defines a flag for each setting on fs, bound to (and
+// defaulting to) the fields of c
+func (c *Config) RegisterFlags(fs *flag.FlagSet) {
+	fs.StringVar(&c.Source, "source", c.Source, "source (for reporting)")
+	fs.IntVar(&c.Interval, "interval", c.Interval, "stats interval (in seconds)")
+	fs.IntVar(&c.Timeout, "timeout", c.Timeout, "receive timeout (in ms)")
+	fs.StringVar(&c.Survey, "survey", c.Survey, "survey schedule, e.g. '1:conns,msgs;6:*' (defaults to all stats every interval)")
+	fs.StringVar(&c.Registration, "registration", c.Registration, "address to which clients register")
+	fs.StringVar(&c.Transport, "transport", c.Transport, "default transport for registration and clients (zmq,framed)")
+	fs.IntVar(&c.Heartbeat, "heartbeat", c.Heartbeat, "client heartbeat period (in ms, 0 to disable)")
+	fs.IntVar(&c.HeartbeatMissed, "heartbeat_missed", c.HeartbeatMissed, "missed heartbeats before a client is disconnected (0 to never disconnect)")
+	fs.StringVar(&c.Relay, "relay", c.Relay, "relay mode: aggregate the output of these upstream staggers (comma separated, e.g. 'tcp://dc1:5563,tcp://dc2:5563') instead of surveying clients")
+	fs.IntVar(&c.RelayTimeout, "relay_timeout", c.RelayTimeout, "time to wait for all upstreams to report a timestamp (in ms)")
+	fs.StringVar(&c.Pub.Addr, "pub", c.Pub.Addr, "ZMQ PUB address publishing aggregated data (empty to disable)")
+	fs.StringVar(&c.StatsD, "statsd", c.StatsD, "StatsD listen address (e.g. ':8125' or 'unixgram:///tmp/statsd.sock')")
+	fs.BoolVar(&c.LogOutput, "log_output", c.LogOutput, "log aggregated data")
+	fs.IntVar(&c.ShutdownTimeout, "shutdown_timeout", c.ShutdownTimeout, "time allowed for outputters to output queued data on shutdown, after the final survey (in ms)")
+	fs.StringVar(&c.Librato.Email, "librato_email", c.Librato.Email, "librato email")
+	fs.StringVar(&c.Librato.Token, "librato_token", c.Librato.Token, "librato token")
+	fs.StringVar(&c.Graphite.Addr, "graphite", c.Graphite.Addr, "graphite plaintext protocol address (e.g. 'graphite:2003', pickle isn't supported)")
+	fs.StringVar(&c.Graphite.Prefix, "graphite_prefix", c.Graphite.Prefix, "graphite metric prefix ({source} is replaced with -source)")
+	fs.StringVar(&c.InfluxDB.URL, "influxdb", c.InfluxDB.URL, "influxdb write url (e.g. 'http://localhost:8086/write?db=stagger' or 'udp://localhost:8089')")
+	fs.StringVar(&c.File.Path, "file", c.File.Path, "append aggregated data to this file as JSON lines")
+	fs.Int64Var(&c.File.MaxSize, "file_max_size", c.File.MaxSize, "rotate the output file at this size (in MB, 0 to disable)")
+	fs.DurationVar(&c.File.MaxAge, "file_max_age", c.File.MaxAge, "rotate the output file at this age (0 to disable)")
+	fs.BoolVar(&c.File.Gzip, "file_gzip", c.File.Gzip, "gzip rotated output files")
+	fs.IntVar(&c.File.Keep, "file_keep", c.File.Keep, "rotated output files to keep (0 to keep all)")
+	fs.StringVar(&c.History.Dir, "history", c.History.Dir, "store history with roll-ups in this directory")
+	fs.DurationVar(&c.History.Raw, "history_raw", c.History.Raw, "history retention for raw intervals")
+	fs.DurationVar(&c.History.OneM, "history_1m", c.History.OneM, "history retention for 1 minute roll-ups")
+	fs.DurationVar(&c.History.OneH, "history_1h", c.History.OneH, "history retention for 1 hour roll-ups")
+	fs.DurationVar(&c.History.OneD, "history_1d", c.History.OneD, "history retention for 1 day roll-ups")
+	fs.StringVar(&c.HTTP.Addr, "http", c.HTTP.Addr, "HTTP debugging address (e.g. ':8990')")
+	fs.StringVar(&c.HTTP.HTTPSAddr, "https", c.HTTP.HTTPSAddr, "HTTPS address (e.g. ':8443')")
+	fs.StringVar(&c.HTTP.Features, "features", c.HTTP.Features, "HTTP features (ws-json,http-json,history-json,prometheus,sparkline,ingest)")
+	fs.IntVar(&c.HTTP.WSBacklog, "ws_backlog", c.HTTP.WSBacklog, "intervals replayed to new websocket connections")
+	fs.StringVar(&c.HTTP.Crt, "crt", c.HTTP.Crt, "SSL Certificate")
+	fs.StringVar(&c.HTTP.Key, "key", c.HTTP.Key, "SSL Key")
+	fs.StringVar(&c.HTTP.CA, "ca", c.HTTP.CA, "Client certificate CA (If left unspecified, client certificates are not used)")
+}
+
+// LoadConfig reads the config file at path (if any) over the defaults, then
+// applies the flags which were set on the command line, given by name
+func LoadConfig(path string, set map[string]string) (*Config, error) {
+	c := DefaultConfig()
+	if path != "" {
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		if err := yaml.UnmarshalStrict(data, c); err != nil {
+			return nil, err
+		}
+	}
+
+	fs := flag.NewFlagSet("config", flag.ContinueOnError)
+	c.RegisterFlags(fs)
+	for name, value := range set {
+		if fs.Lookup(name) == nil {
+			// e.g. -config itself
+			continue
+		}
+		if err := fs.Set(name, value); err != nil {
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+// SourceFor returns an outputter's source, defaulting to the top level one
+func (c *Config) SourceFor(source string) string {
+	if source != "" {
+		return source
+	}
+	return c.Source
+}
+
+func (c *Config) HTTPFeatures() map[string]bool {
+	features := make(map[string]bool)
+	for _, s := range strings.Split(c.HTTP.Features, ",") {
+		features[s] = true
+	}
+	return features
+}
+
+// Static returns a copy of the config without the settings which can be
+// reloaded, so that changes requiring a restart can be detected
+func (c *Config) Static() Config {
+	s := *c
+	s.Interval = 0
+	s.Timeout = 0
+	s.Survey = ""
+	s.Source = ""
+	s.LogOutput = false
+	s.Librato = LibratoConfig{}
+	s.Graphite = GraphiteConfig{}
+	s.InfluxDB = InfluxDBConfig{}
+	s.File = FileConfig{}
+	s.History = HistoryConfig{}
+	s.Pub = PubConfig{}
+	s.HTTP.Features = ""
+	s.HTTP.WSBacklog = 0
+	return s
+}
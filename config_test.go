@@ -0,0 +1,75 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func Test_LoadConfig(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "stagger")
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "stagger.yaml")
+	ioutil.WriteFile(path, []byte(`
+source: web1
+interval: 5
+graphite:
+  addr: graphite:2003
+  source: web1.dc1
+file:
+  path: /var/log/stagger.json
+  max_age: 1h
+http:
+  features: prometheus
+`), 0644)
+
+	c, err := LoadConfig(path, map[string]string{"interval": "20", "config": path})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Interval != 20 {
+		t.Errorf("expected the command line to take precedence, got interval %v", c.Interval)
+	}
+	if c.Source != "web1" || c.Graphite.Addr != "graphite:2003" || c.File.MaxAge != time.Hour {
+		t.Errorf("file settings not applied: %+v", c)
+	}
+	if c.SourceFor(c.Graphite.Source) != "web1.dc1" || c.SourceFor(c.Librato.Source) != "web1" {
+		t.Errorf("per-output source not applied: %+v", c)
+	}
+	if c.File.Keep != 7 || c.Graphite.Prefix != "stagger.{source}" {
+		t.Errorf("expected defaults for unset settings: %+v", c)
+	}
+	if f := c.HTTPFeatures(); !f["prometheus"] || f["ws-json"] {
+		t.Errorf("unexpected features %v", f)
+	}
+
+	ioutil.WriteFile(path, []byte("grahpite:\n  addr: x\n"), 0644)
+	if _, err := LoadConfig(path, nil); err == nil {
+		t.Error("expected an error for an unknown setting")
+	}
+}
+
+func Test_ExampleConfigLoads(t *testing.T) {
+	if _, err := LoadConfig("docs/config.example.yaml", nil); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func Test_ConfigStatic(t *testing.T) {
+	a := DefaultConfig()
+	b := DefaultConfig()
+	b.Source = "other"
+	b.Graphite.Addr = "graphite:2003"
+	b.HTTP.Features = "prometheus"
+	b.Interval = 60
+	b.Survey = "1:conns;6:*"
+	if a.Static() != b.Static() {
+		t.Error("expected reloadable settings to be ignored")
+	}
+	b.Registration = "tcp://127.0.0.1:5868"
+	if a.Static() == b.Static() {
+		t.Error("expected registration change to require a restart")
+	}
+}
@@ -13,8 +13,9 @@ type Dist struct {
 	Sum_x2 float64
 }
 
-func NewDistFromValue(v float64) *Dist {
-	return &Dist{1, v, v, v, v * v}
+// NewDistFromValue creates a Dist from a single value standing in for w samples
+func NewDistFromValue(v, w float64) *Dist {
+	return &Dist{w, v, v, w * v, w * v * v}
 }
 
 func ContstructDist(vs [5]float64) *Dist {
@@ -27,12 +28,13 @@ func ContstructDist(vs [5]float64) *Dist {
 	}
 }
 
-func (self *Dist) AddEntry(v float64) {
+// AddEntry adds a value standing in for w samples
+func (self *Dist) AddEntry(v, w float64) {
 	self.Min = math.Min(self.Min, v)
 	self.Max = math.Max(self.Max, v)
-	self.Sum_x += v
-	self.Sum_x2 += v * v
-	self.N += 1
+	self.Sum_x += w * v
+	self.Sum_x2 += w * v * v
+	self.N += w
 }
 
 func (self *Dist) Add(dist *Dist) {
@@ -1,11 +1,14 @@
 package main
 
-import "testing"
+import (
+	"math"
+	"testing"
+)
 
 func Test_AddingValuesToDists(t *testing.T) {
-	d := NewDistFromValue(1)
-	d.AddEntry(3)
-	d.AddEntry(5)
+	d := NewDistFromValue(1, 1)
+	d.AddEntry(3, 1)
+	d.AddEntry(5, 1)
 
 	if d.Mean() != 3 {
 		t.Fail()
@@ -40,3 +43,18 @@ func Test_AddingDistsTogether(t *testing.T) {
 		t.Fail()
 	}
 }
+
+func Test_AddingWeightedValuesToDists(t *testing.T) {
+	d := NewDistFromValue(1, 3)
+	d.AddEntry(5, 1)
+
+	if d.Mean() != 2 {
+		t.Fail()
+	}
+	if d.N != 4 {
+		t.Fail()
+	}
+	if d.Sd() != math.Sqrt(3) {
+		t.Fail()
+	}
+}
@@ -0,0 +1,219 @@
+// Appends each aggregated interval to a file as one JSON object per line. The file is rotated once it reaches a maximum size or age; rotated files are renamed with the time of rotation (in UTC), optionally gzipped, and only the most recent are kept.
+
+package main
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Suffix of rotated files (in UTC), before any .gz
+const fileRotatedFormat = "20060102-150405.000"
+
+type FileOutput struct {
+	path     string
+	maxSize  int64         // bytes, 0 for no limit
+	maxAge   time.Duration // 0 for no limit
+	compress bool
+	keep     int // rotated files to keep, 0 to keep all
+	on_stats chan *TimestampedStats
+	didStop  chan bool
+	file     *os.File
+	size     int64
+	opened   time.Time
+}
+
+func NewFileOutput(path string, maxSize int64, maxAge time.Duration, compress bool, keep int) *FileOutput {
+	return &FileOutput{
+		path:     path,
+		maxSize:  maxSize,
+		maxAge:   maxAge,
+		compress: compress,
+		keep:     keep,
+		on_stats: make(chan *TimestampedStats, 100),
+		didStop:  make(chan bool),
+	}
+}
+
+func (f *FileOutput) Run() {
+	for stats := range f.on_stats {
+		if err := f.write(stats); err != nil {
+			info.Printf("[file] Error writing to %v: %v", f.path, err)
+		}
+	}
+	if f.file != nil {
+		f.file.Close()
+	}
+	close(f.didStop)
+}
+
+func (f *FileOutput) Send(stats *TimestampedStats) {
+	f.on_stats <- stats
+}
+
+// Stop writes any queued stats and closes the file, returning once done. Send
+// must not be called afterwards
+func (f *FileOutput) Stop() {
+	close(f.on_stats)
+	<-f.didStop
+}
+
+func (f *FileOutput) write(stats *TimestampedStats) error {
+	b, err := json.Marshal(stats)
+	if err != nil {
+		return err
+	}
+	b = append(b, '\n')
+
+	if f.file != nil && f.shouldRotate(int64(len(b))) {
+		f.rotate()
+	}
+	if f.file == nil {
+		if err := f.open(); err != nil {
+			return err
+		}
+	}
+
+	n, err := f.file.Write(b)
+	f.size += int64(n)
+	return err
+}
+
+func (f *FileOutput) shouldRotate(next int64) bool {
+	if f.size == 0 {
+		return false
+	}
+	if f.maxSize > 0 && f.size+next > f.maxSize {
+		return true
+	}
+	return f.maxAge > 0 && time.Since(f.opened) >= f.maxAge
+}
+
+func (f *FileOutput) open() error {
+	file, err := os.OpenFile(f.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	fi, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	f.file = file
+	f.size = fi.Size()
+	f.opened = time.Now()
+	if f.size > 0 {
+		// Appending to an existing file, so its age counts from the first
+		// interval written to it, or failing that its last modification
+		f.opened = fi.ModTime()
+		if ts, err := firstTimestamp(f.path); err == nil {
+			f.opened = time.Unix(ts, 0)
+		}
+	}
+	return nil
+}
+
+// firstTimestamp returns the timestamp of the first interval in a file
+func firstTimestamp(path string) (int64, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+	var stats TimestampedStats
+	if err := json.NewDecoder(file).Decode(&stats); err != nil {
+		return 0, err
+	}
+	return stats.Timestamp, nil
+}
+
+func (f *FileOutput) rotate() {
+	f.file.Close()
+	f.file = nil
+
+	rotated := f.path + "." + time.Now().UTC().Format(fileRotatedFormat)
+	if err := os.Rename(f.path, rotated); err != nil {
+		info.Printf("[file] Error rotating %v: %v", f.path, err)
+		return
+	}
+	if f.compress {
+		if err := gzipFile(rotated); err != nil {
+			info.Printf("[file] Error compressing %v: %v", rotated, err)
+		}
+	}
+	f.prune()
+}
+
+func gzipFile(path string) error {
+	in, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.Create(path + ".gz")
+	if err != nil {
+		return err
+	}
+	gz := gzip.NewWriter(out)
+	if _, err = io.Copy(gz, in); err == nil {
+		err = gz.Close()
+	}
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(path + ".gz")
+		return err
+	}
+	return os.Remove(path)
+}
+
+// rotatedFiles lists the files rotated from path, i.e. named with the path
+// followed by the time of rotation and optionally .gz
+func rotatedFiles(path string) ([]string, error) {
+	entries, err := ioutil.ReadDir(filepath.Dir(path))
+	if err != nil {
+		return nil, err
+	}
+	prefix := filepath.Base(path) + "."
+	var rotated []string
+	for _, e := range entries {
+		name := e.Name()
+		if e.IsDir() || !strings.HasPrefix(name, prefix) {
+			continue
+		}
+		suffix := strings.TrimSuffix(name[len(prefix):], ".gz")
+		if _, err := time.Parse(fileRotatedFormat, suffix); err == nil {
+			rotated = append(rotated, filepath.Join(filepath.Dir(path), name))
+		}
+	}
+	return rotated, nil
+}
+
+// prune removes the oldest rotated files beyond the retention count. Rotated
+// names sort by the time of rotation
+func (f *FileOutput) prune() {
+	if f.keep <= 0 {
+		return
+	}
+	rotated, err := rotatedFiles(f.path)
+	if err != nil {
+		info.Printf("[file] Error listing rotated files: %v", err)
+		return
+	}
+	sort.Strings(rotated)
+	for len(rotated) > f.keep {
+		if err := os.Remove(rotated[0]); err != nil {
+			info.Printf("[file] Error removing %v: %v", rotated[0], err)
+		}
+		rotated = rotated[1:]
+	}
+}
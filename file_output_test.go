@@ -0,0 +1,78 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func Test_FileOutputRotatesAndPrunes(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "stagger")
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "stats.json")
+
+	// Files which merely share the prefix are left alone
+	for _, name := range []string{"stats.json.bak", "stats.json.lock", "stats.json.20200101-000000.000.old"} {
+		ioutil.WriteFile(filepath.Join(dir, name), nil, 0644)
+	}
+
+	f := NewFileOutput(path, 1, 0, true, 2)
+	for i := 0; i < 4; i++ {
+		if err := f.write(NewTimestampedStats(int64(i))); err != nil {
+			t.Fatal(err)
+		}
+		// Rotated names have millisecond resolution
+		time.Sleep(2 * time.Millisecond)
+	}
+
+	rotated, _ := filepath.Glob(path + ".*.gz")
+	if len(rotated) != 2 {
+		t.Fatalf("expected 2 rotated files, got %v", rotated)
+	}
+	for _, r := range rotated {
+		if !strings.HasSuffix(r, ".gz") {
+			t.Errorf("expected %v to be compressed", r)
+		}
+	}
+
+	for _, name := range []string{"stats.json.bak", "stats.json.lock", "stats.json.20200101-000000.000.old"} {
+		if _, err := os.Stat(filepath.Join(dir, name)); err != nil {
+			t.Errorf("expected %v to be kept: %v", name, err)
+		}
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	var stats TimestampedStats
+	s := bufio.NewScanner(file)
+	s.Scan()
+	if err := json.Unmarshal(s.Bytes(), &stats); err != nil || stats.Timestamp != 3 {
+		t.Errorf("expected last interval in current file, got %v (%v)", stats.Timestamp, err)
+	}
+}
+
+func Test_FileOutputAgeCountsFromExistingFile(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "stagger")
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "stats.json")
+	old := time.Now().Add(-2 * time.Hour).Unix()
+	ioutil.WriteFile(path, []byte(`{"Timestamp":`+strconv.FormatInt(old, 10)+"}\n"), 0644)
+
+	f := NewFileOutput(path, 0, time.Hour, false, 0)
+	if err := f.open(); err != nil {
+		t.Fatal(err)
+	}
+	defer f.file.Close()
+	if !f.shouldRotate(1) {
+		t.Errorf("expected a file started %v to be rotated", time.Unix(old, 0))
+	}
+}
@@ -0,0 +1,137 @@
+// Output to Graphite using the plaintext protocol (`name value timestamp`) over TCP. Lines are buffered while Graphite is unreachable, and sent once it can be reconnected to. The pickle protocol isn't supported.
+//
+// Graphite can't store NaN or infinite values, so they are skipped (e.g. the mean and sd of a dist with no weight).
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"net"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Lines kept while disconnected, beyond which the oldest are dropped
+const graphiteMaxBuffered = 100000
+
+// Characters which can't appear in a plaintext protocol name, including
+// whitespace which would split the line
+var graphiteInvalidName = regexp.MustCompile(`[^A-Za-z0-9._:-]`)
+
+type Graphite struct {
+	addr     string
+	prefix   string
+	on_stats chan *TimestampedStats
+	didStop  chan bool
+	conn     net.Conn
+	buffered []string
+}
+
+// NewGraphite creates a Graphite outputter. Any {source} in the prefix is
+// replaced with the source, with dots replaced so it stays one path segment
+func NewGraphite(addr, prefix, source string) *Graphite {
+	prefix = strings.Replace(prefix, "{source}", strings.Replace(source, ".", "_", -1), -1)
+	return &Graphite{
+		addr:   addr,
+		prefix: strings.TrimSuffix(prefix, "."),
+		// Handle slow writes by combination of buffering channel & timing out
+		on_stats: make(chan *TimestampedStats, 100),
+		didStop:  make(chan bool),
+	}
+}
+
+func (g *Graphite) Run() {
+	for stats := range g.on_stats {
+		g.buffered = append(g.buffered, g.lines(stats)...)
+		if over := len(g.buffered) - graphiteMaxBuffered; over > 0 {
+			info.Printf("[graphite] Buffer full, dropping %v lines", over)
+			g.buffered = g.buffered[over:]
+		}
+		g.flush()
+	}
+	if g.conn != nil {
+		g.conn.Close()
+	}
+	close(g.didStop)
+}
+
+func (g *Graphite) Send(stats *TimestampedStats) {
+	g.on_stats <- stats
+}
+
+// Stop writes any queued stats and closes the connection, returning once
+// done. Lines which can't be written by then are lost. Send must not be
+// called afterwards
+func (g *Graphite) Stop() {
+	close(g.on_stats)
+	<-g.didStop
+}
+
+func (g *Graphite) name(key string) string {
+	if g.prefix != "" {
+		key = g.prefix + "." + key
+	}
+	return graphiteInvalidName.ReplaceAllString(key, "_")
+}
+
+func (g *Graphite) lines(stats *TimestampedStats) []string {
+	var lines []string
+	line := func(name string, value float64) {
+		if math.IsNaN(value) || math.IsInf(value, 0) {
+			return
+		}
+		lines = append(lines, fmt.Sprintf("%v %v %v\n", g.name(name), value, stats.Timestamp))
+	}
+	for key, value := range stats.Counters {
+		line(key, value)
+	}
+	for key, value := range stats.Dists {
+		line(key+".mean", value.Mean())
+		line(key+".sd", value.Sd())
+		line(key+".min", value.Min)
+		line(key+".max", value.Max)
+		line(key+".count", value.N)
+	}
+	for key, value := range stats.Histograms {
+		line(key+".p50", value.P50())
+		line(key+".p90", value.P90())
+		line(key+".p99", value.P99())
+		line(key+".count", value.N())
+	}
+	sort.Strings(lines)
+	return lines
+}
+
+func (g *Graphite) flush() {
+	if len(g.buffered) == 0 {
+		return
+	}
+	if g.conn == nil {
+		conn, err := net.DialTimeout("tcp", g.addr, 2*time.Second)
+		if err != nil {
+			info.Printf("[graphite] Error connecting to %v, buffering %v lines: %v", g.addr, len(g.buffered), err)
+			return
+		}
+		info.Printf("[graphite] Connected to %v", g.addr)
+		g.conn = conn
+	}
+
+	var b bytes.Buffer
+	for _, l := range g.buffered {
+		b.WriteString(l)
+	}
+	g.conn.SetWriteDeadline(time.Now().Add(2 * time.Second))
+	if _, err := g.conn.Write(b.Bytes()); err != nil {
+		// Lines may have been partially written, but resending is preferable
+		// to losing them
+		info.Printf("[graphite] Error writing, will reconnect: %v", err)
+		g.conn.Close()
+		g.conn = nil
+		return
+	}
+	g.buffered = g.buffered[:0]
+}
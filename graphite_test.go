@@ -0,0 +1,88 @@
+package main
+
+import (
+	"bufio"
+	"math"
+	"net"
+	"testing"
+)
+
+func Test_GraphiteLines(t *testing.T) {
+	g := NewGraphite("", "stagger.{source}", "web1.example.com")
+	stats := NewTimestampedStats(100)
+	stats.AddCount(StatCount{"requests", 3, nil})
+	stats.AddValue(StatValue{Name: "latency", Value: 10})
+
+	expected := []string{
+		"stagger.web1_example_com.latency.count 1 100\n",
+		"stagger.web1_example_com.latency.max 10 100\n",
+		"stagger.web1_example_com.latency.mean 10 100\n",
+		"stagger.web1_example_com.latency.min 10 100\n",
+		"stagger.web1_example_com.latency.sd 0 100\n",
+		"stagger.web1_example_com.requests 3 100\n",
+	}
+	lines := g.lines(stats)
+	if len(lines) != len(expected) {
+		t.Fatalf("lines: %q", lines)
+	}
+	for i, l := range expected {
+		if lines[i] != l {
+			t.Errorf("expected %q, got %q", l, lines[i])
+		}
+	}
+}
+
+func Test_GraphiteSanitisesNames(t *testing.T) {
+	g := NewGraphite("", "stagger.{source}", "web 1")
+	stats := NewTimestampedStats(100)
+	stats.AddCount(StatCount{"requests.path:/a b\nc", 3, nil})
+
+	lines := g.lines(stats)
+	if len(lines) != 1 || lines[0] != "stagger.web_1.requests.path:_a_b_c 3 100\n" {
+		t.Errorf("unexpected lines %q", lines)
+	}
+}
+
+func Test_GraphiteSkipsNonFiniteValues(t *testing.T) {
+	g := NewGraphite("", "", "")
+	stats := NewTimestampedStats(100)
+	stats.AddCount(StatCount{"nan", math.NaN(), nil})
+	stats.AddCount(StatCount{"inf", math.Inf(1), nil})
+	stats.Dists["empty"] = &Dist{}
+
+	lines := g.lines(stats)
+	if len(lines) != 3 || lines[0] != "empty.count 0 100\n" || lines[1] != "empty.max 0 100\n" || lines[2] != "empty.min 0 100\n" {
+		t.Errorf("unexpected lines %q", lines)
+	}
+}
+
+func Test_GraphiteBuffersUntilConnected(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+
+	g := NewGraphite(addr, "", "")
+	g.buffered = []string{"a 1 100\n"}
+	g.flush()
+	if len(g.buffered) != 1 {
+		t.Fatal("expected line to stay buffered while disconnected")
+	}
+
+	l, err = net.Listen("tcp", addr)
+	if err != nil {
+		t.Skip("could not rebind test port")
+	}
+	defer l.Close()
+	g.flush()
+	conn, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	line, _ := bufio.NewReader(conn).ReadString('\n')
+	if line != "a 1 100\n" || len(g.buffered) != 0 {
+		t.Errorf("unexpected line %q, %v buffered", line, len(g.buffered))
+	}
+}
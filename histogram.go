@@ -0,0 +1,109 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+)
+
+// A bucketed distribution. Bounds are the ascending upper bounds of each
+// bucket, and Counts holds the weight in each bucket. There is one more count
+// than bounds, the last bucket holding values above the final bound.
+type Histogram struct {
+	Bounds []float64
+	Counts []float64
+}
+
+func NewHistogram(bounds, counts []float64) (*Histogram, error) {
+	if len(counts) != len(bounds)+1 {
+		return nil, fmt.Errorf("histogram has %v bounds but %v counts", len(bounds), len(counts))
+	}
+	if !sort.Float64sAreSorted(bounds) {
+		return nil, fmt.Errorf("histogram bounds are not ascending: %v", bounds)
+	}
+	h := &Histogram{
+		make([]float64, len(bounds)),
+		make([]float64, len(counts)),
+	}
+	copy(h.Bounds, bounds)
+	copy(h.Counts, counts)
+	return h, nil
+}
+
+// Add merges another histogram into this one. Buckets with the same bound are
+// summed; histograms with different bounds are merged into the union of both,
+// which keeps every count within its original upper bound.
+func (self *Histogram) Add(h *Histogram) {
+	counts := map[float64]float64{}
+	for i, b := range self.Bounds {
+		counts[b] += self.Counts[i]
+	}
+	for i, b := range h.Bounds {
+		counts[b] += h.Counts[i]
+	}
+	overflow := self.Counts[len(self.Bounds)] + h.Counts[len(h.Bounds)]
+
+	bounds := make([]float64, 0, len(counts))
+	for b := range counts {
+		bounds = append(bounds, b)
+	}
+	sort.Float64s(bounds)
+
+	self.Bounds = bounds
+	self.Counts = make([]float64, len(bounds)+1)
+	for i, b := range bounds {
+		self.Counts[i] = counts[b]
+	}
+	self.Counts[len(bounds)] = overflow
+}
+
+func (self *Histogram) N() (n float64) {
+	for _, c := range self.Counts {
+		n += c
+	}
+	return
+}
+
+// Quantile estimates the value below which a fraction q of the weight lies,
+// interpolating linearly within the bucket. Values in the overflow bucket are
+// reported as the final bound.
+func (self *Histogram) Quantile(q float64) float64 {
+	n := self.N()
+	if n == 0 || len(self.Bounds) == 0 {
+		return 0
+	}
+	target := q * n
+	var cumulative float64
+	for i, c := range self.Counts[:len(self.Bounds)] {
+		if c > 0 && cumulative+c >= target {
+			lower := 0.0
+			if i > 0 {
+				lower = self.Bounds[i-1]
+			} else if self.Bounds[0] < 0 {
+				lower = self.Bounds[0]
+			}
+			return lower + (self.Bounds[i]-lower)*(target-cumulative)/c
+		}
+		cumulative += c
+	}
+	return self.Bounds[len(self.Bounds)-1]
+}
+
+func (self *Histogram) P50() float64 { return self.Quantile(0.5) }
+func (self *Histogram) P90() float64 { return self.Quantile(0.9) }
+func (self *Histogram) P99() float64 { return self.Quantile(0.99) }
+
+func (self *Histogram) MarshalJSON() ([]byte, error) {
+	return json.Marshal(map[string]interface{}{
+		"Bounds": self.Bounds,
+		"Counts": self.Counts,
+		"N":      self.N(),
+		"P50":    self.P50(),
+		"P90":    self.P90(),
+		"P99":    self.P99(),
+	})
+}
+
+func (self *Histogram) String() string {
+	return fmt.Sprintf("Histogram: p50: %.5g, p90: %.5g, p99: %.5g (weight %.5g)", self.P50(), self.P90(), self.P99(), self.N())
+}
@@ -0,0 +1,48 @@
+package main
+
+import "testing"
+
+func Test_HistogramQuantiles(t *testing.T) {
+	h, err := NewHistogram([]float64{10, 20, 30}, []float64{50, 40, 10, 0})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if h.N() != 100 {
+		t.Errorf("N: %v", h.N())
+	}
+	if h.P50() != 10 {
+		t.Errorf("p50: %v", h.P50())
+	}
+	if h.P90() != 20 {
+		t.Errorf("p90: %v", h.P90())
+	}
+	if h.P99() != 29 {
+		t.Errorf("p99: %v", h.P99())
+	}
+}
+
+func Test_AddingHistogramsTogether(t *testing.T) {
+	h, _ := NewHistogram([]float64{10, 20}, []float64{1, 2, 3})
+	h2, _ := NewHistogram([]float64{10, 30}, []float64{1, 1, 1})
+
+	h.Add(h2)
+
+	if len(h.Bounds) != 3 || h.Bounds[2] != 30 {
+		t.Errorf("bounds: %v", h.Bounds)
+	}
+	expected := []float64{2, 2, 1, 4}
+	for i, c := range expected {
+		if h.Counts[i] != c {
+			t.Errorf("counts: %v", h.Counts)
+		}
+	}
+}
+
+func Test_InvalidHistogram(t *testing.T) {
+	if _, err := NewHistogram([]float64{10, 20}, []float64{1, 2}); err == nil {
+		t.Error("expected error for missing overflow bucket")
+	}
+	if _, err := NewHistogram([]float64{20, 10}, []float64{1, 2, 3}); err == nil {
+		t.Error("expected error for unsorted bounds")
+	}
+}
@@ -0,0 +1,269 @@
+// Stores aggregated intervals on disk, along with roll-ups at 1 minute, 1 hour and 1 day resolutions. Roll-ups sum counters and add Dists together, so a roll-up is the same as if a single interval had spanned the whole period.
+//
+// Each resolution is stored in its own directory as files of JSON lines, one file per day (raw and 1m), month (1h) or year (1d). Whole files are deleted once they are older than the retention for their resolution. The roll-up currently being built for each resolution is held in memory, and rebuilt from the finer resolutions on disk when stagger restarts. (A roll-up whose period ended while stagger was stopped is lost.)
+
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+type resolution struct {
+	name      string
+	step      int64  // seconds, 0 for raw intervals
+	layout    string // time layout of each file's period
+	retention time.Duration
+}
+
+var historyResolutions = []string{"raw", "1m", "1h", "1d"}
+
+type History struct {
+	dir         string
+	resolutions []*resolution
+	open        []*TimestampedStats // roll-up being built, by resolution
+	on_stats    chan *TimestampedStats
+	didStop     chan bool
+	mutex       sync.Mutex
+	lastPrune   time.Time
+}
+
+// NewHistory creates a history store in dir, with the retention for each
+// resolution (raw, 1m, 1h, 1d) given in order
+func NewHistory(dir string, retention [4]time.Duration) (*History, error) {
+	h := &History{
+		dir: dir,
+		resolutions: []*resolution{
+			{"raw", 0, "2006-01-02", retention[0]},
+			{"1m", 60, "2006-01-02", retention[1]},
+			{"1h", 3600, "2006-01", retention[2]},
+			{"1d", 86400, "2006", retention[3]},
+		},
+		open:     make([]*TimestampedStats, 4),
+		on_stats: make(chan *TimestampedStats, 100),
+		didStop:  make(chan bool),
+	}
+	for _, r := range h.resolutions {
+		if err := os.MkdirAll(filepath.Join(dir, r.name), 0755); err != nil {
+			return nil, err
+		}
+	}
+	if err := h.restore(time.Now().Unix()); err != nil {
+		return nil, err
+	}
+	return h, nil
+}
+
+func (h *History) Run() {
+	for stats := range h.on_stats {
+		if err := h.add(stats); err != nil {
+			info.Printf("[history] Error storing (ts:%v): %v", stats.Timestamp, err)
+		}
+	}
+	close(h.didStop)
+}
+
+func (h *History) Send(stats *TimestampedStats) {
+	h.on_stats <- stats
+}
+
+// Stop stores any queued stats and returns once done. Open roll-ups are
+// rebuilt from the raw intervals when the directory is next opened. Send must
+// not be called afterwards, but Query may be
+func (h *History) Stop() {
+	close(h.on_stats)
+	<-h.didStop
+}
+
+func (h *History) resolution(name string) (int, *resolution) {
+	for i, r := range h.resolutions {
+		if r.name == name {
+			return i, r
+		}
+	}
+	return -1, nil
+}
+
+func (r *resolution) bucket(ts int64) int64 {
+	return ts - ts%r.step
+}
+
+func (r *resolution) file(dir string, ts int64) string {
+	return filepath.Join(dir, r.name, time.Unix(ts, 0).UTC().Format(r.layout)+".json")
+}
+
+func (h *History) add(stats *TimestampedStats) error {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	if stats.Empty {
+		return nil
+	}
+	if err := h.append(h.resolutions[0], stats); err != nil {
+		return err
+	}
+	for i, r := range h.resolutions[1:] {
+		i += 1
+		bucket := r.bucket(stats.Timestamp)
+		if open := h.open[i]; open != nil && open.Timestamp != bucket {
+			if err := h.append(r, open); err != nil {
+				return err
+			}
+			h.open[i] = nil
+		}
+		if h.open[i] == nil {
+			h.open[i] = NewTimestampedStats(bucket)
+		}
+		h.open[i].Merge(stats)
+	}
+
+	if time.Since(h.lastPrune) > time.Hour {
+		h.prune(time.Now())
+		h.lastPrune = time.Now()
+	}
+	return nil
+}
+
+func (h *History) append(r *resolution, stats *TimestampedStats) error {
+	b, err := json.Marshal(stats)
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(r.file(h.dir, stats.Timestamp), os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(append(b, '\n'))
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// restore rebuilds the open roll-ups from the finer resolutions on disk, each
+// including the finer resolution's own open roll-up
+func (h *History) restore(now int64) error {
+	for i, r := range h.resolutions[1:] {
+		i += 1
+		bucket := r.bucket(now)
+		open := NewTimestampedStats(bucket)
+		finer, err := h.read(h.resolutions[i-1], bucket, now)
+		if err != nil {
+			return err
+		}
+		for _, stats := range finer {
+			open.Merge(stats)
+		}
+		if previous := h.open[i-1]; previous != nil {
+			open.Merge(previous)
+		}
+		if !open.Empty {
+			h.open[i] = open
+		}
+	}
+	return nil
+}
+
+// read returns the stored stats for a resolution with from <= ts <= to
+func (h *History) read(r *resolution, from, to int64) ([]*TimestampedStats, error) {
+	var results []*TimestampedStats
+	files, err := filepath.Glob(filepath.Join(h.dir, r.name, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(files)
+	for _, name := range files {
+		start, end, err := r.period(name)
+		if err != nil || end <= from || start > to {
+			continue
+		}
+		if results, err = readHistoryFile(name, from, to, results); err != nil {
+			return nil, err
+		}
+	}
+	return results, nil
+}
+
+// period returns the start and end of the period stored in a file
+func (r *resolution) period(name string) (start, end int64, err error) {
+	t, err := time.Parse(r.layout, strings.TrimSuffix(filepath.Base(name), ".json"))
+	if err != nil {
+		return
+	}
+	switch r.layout {
+	case "2006":
+		return t.Unix(), t.AddDate(1, 0, 0).Unix(), nil
+	case "2006-01":
+		return t.Unix(), t.AddDate(0, 1, 0).Unix(), nil
+	}
+	return t.Unix(), t.AddDate(0, 0, 1).Unix(), nil
+}
+
+func readHistoryFile(name string, from, to int64, results []*TimestampedStats) ([]*TimestampedStats, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return results, err
+	}
+	defer f.Close()
+
+	s := bufio.NewScanner(f)
+	s.Buffer(make([]byte, 64*1024), 64<<20)
+	for s.Scan() {
+		stats := NewTimestampedStats(-1)
+		if err := json.Unmarshal(s.Bytes(), stats); err != nil {
+			// A partially written last line is expected after a crash
+			info.Printf("[history] Skipping invalid line in %v: %v", name, err)
+			continue
+		}
+		if stats.Timestamp >= from && stats.Timestamp <= to {
+			results = append(results, stats)
+		}
+	}
+	return results, s.Err()
+}
+
+// prune deletes files whose whole period is older than the retention
+func (h *History) prune(now time.Time) {
+	for _, r := range h.resolutions {
+		if r.retention <= 0 {
+			continue
+		}
+		cutoff := now.Add(-r.retention).Unix()
+		files, _ := filepath.Glob(filepath.Join(h.dir, r.name, "*.json"))
+		for _, name := range files {
+			if _, end, err := r.period(name); err == nil && end <= cutoff {
+				debug.Printf("[history] Removing %v", name)
+				if err := os.Remove(name); err != nil {
+					info.Printf("[history] Error removing %v: %v", name, err)
+				}
+			}
+		}
+	}
+}
+
+// Query returns the stats stored at a resolution between from and to
+// (inclusive), including the roll-up currently being built
+func (h *History) Query(res string, from, to int64) ([]*TimestampedStats, error) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	i, r := h.resolution(res)
+	if r == nil {
+		return nil, fmt.Errorf("unknown resolution %q (expected one of %v)", res, strings.Join(historyResolutions, ", "))
+	}
+	results, err := h.read(r, from, to)
+	if err != nil {
+		return nil, err
+	}
+	if open := h.open[i]; open != nil && open.Timestamp >= from && open.Timestamp <= to {
+		results = append(results, open)
+	}
+	return results, nil
+}
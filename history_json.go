@@ -0,0 +1,148 @@
+// Serves stored history over http as time series, e.g.
+//
+//     /history.json?metric=api.*&from=1400000000&to=1400003600&resolution=1m
+//
+// `metric` is a glob (where `*` also matches dots) and may be repeated; `prefix` selects every stat starting with a prefix. With neither, all stats are returned. `from` and `to` are unix timestamps, defaulting to the last hour, and `resolution` is one of raw, 1m, 1h or 1d (default raw). Values which are NaN or infinite (e.g. the mean of an empty roll-up) are returned as null.
+
+package main
+
+import (
+	"encoding/json"
+	"math"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// A float which is encoded as null when NaN or infinite (e.g. the mean of an
+// empty roll-up), since JSON can't represent those
+type historyFloat float64
+
+func (f historyFloat) MarshalJSON() ([]byte, error) {
+	if math.IsNaN(float64(f)) || math.IsInf(float64(f), 0) {
+		return []byte("null"), nil
+	}
+	return json.Marshal(float64(f))
+}
+
+type HistoryPoint struct {
+	Timestamp int64
+	Value     historyFloat
+}
+
+type HistoryDistPoint struct {
+	Timestamp int64
+	Mean      historyFloat
+	Sd        historyFloat
+	Min       historyFloat
+	Max       historyFloat
+	N         historyFloat
+}
+
+type HistoryResult struct {
+	Resolution string
+	From       int64
+	To         int64
+	Counters   map[string][]HistoryPoint
+	Dists      map[string][]HistoryDistPoint
+	Types      TypeMap
+}
+
+type HistoryJSON struct {
+	history *History
+}
+
+func NewHistoryJSON(h *History) *HistoryJSON {
+	return &HistoryJSON{h}
+}
+
+// historyMatcher returns whether a stat name was asked for
+func historyMatcher(globs []string, prefix string) func(string) bool {
+	return func(name string) bool {
+		if prefix != "" && strings.HasPrefix(name, prefix) {
+			return true
+		}
+		for _, g := range globs {
+			if ok, _ := path.Match(g, name); ok {
+				return true
+			}
+		}
+		return prefix == "" && len(globs) == 0
+	}
+}
+
+func (s *HistoryJSON) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	q := req.URL.Query()
+	result := HistoryResult{
+		Resolution: q.Get("resolution"),
+		To:         time.Now().Unix(),
+		Counters:   map[string][]HistoryPoint{},
+		Dists:      map[string][]HistoryDistPoint{},
+		Types:      TypeMap{},
+	}
+	if result.Resolution == "" {
+		result.Resolution = "raw"
+	}
+
+	var err error
+	if to := q.Get("to"); to != "" {
+		if result.To, err = strconv.ParseInt(to, 10, 64); err != nil {
+			http.Error(w, "Invalid to: "+to, http.StatusBadRequest)
+			return
+		}
+	}
+	result.From = result.To - 3600
+	if from := q.Get("from"); from != "" {
+		if result.From, err = strconv.ParseInt(from, 10, 64); err != nil {
+			http.Error(w, "Invalid from: "+from, http.StatusBadRequest)
+			return
+		}
+	}
+	for _, g := range q["metric"] {
+		if _, err := path.Match(g, ""); err != nil {
+			http.Error(w, "Invalid metric pattern: "+g, http.StatusBadRequest)
+			return
+		}
+	}
+	match := historyMatcher(q["metric"], q.Get("prefix"))
+
+	series, err := s.history.Query(result.Resolution, result.From, result.To)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	for _, stats := range series {
+		for key, value := range stats.Counters {
+			if match(key) {
+				result.Counters[key] = append(result.Counters[key], HistoryPoint{stats.Timestamp, historyFloat(value)})
+			}
+		}
+		for key, value := range stats.Dists {
+			if match(key) {
+				result.Dists[key] = append(result.Dists[key], HistoryDistPoint{
+					stats.Timestamp,
+					historyFloat(value.Mean()),
+					historyFloat(value.Sd()),
+					historyFloat(value.Min),
+					historyFloat(value.Max),
+					historyFloat(value.N),
+				})
+			}
+		}
+		for key, value := range stats.Types {
+			if match(key) {
+				result.Types[key] = value
+			}
+		}
+	}
+
+	if b, err := json.Marshal(result); err == nil {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(b)
+	} else {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+)
+
+func Test_HistoryJSONMatchesMetrics(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "stagger")
+	defer os.RemoveAll(dir)
+	h, err := NewHistory(dir, [4]time.Duration{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, ts := range []int64{100, 110} {
+		stats := NewTimestampedStats(ts)
+		stats.AddCount(StatCount{"api.requests", 2, nil})
+		stats.AddCount(StatCount{"db.queries", 5, nil})
+		stats.AddValue(StatValue{Name: "api.latency", Value: 10})
+		h.add(stats)
+	}
+
+	w := httptest.NewRecorder()
+	NewHistoryJSON(h).ServeHTTP(w, httptest.NewRequest("GET", "/history.json?metric=api.*&from=0&to=200", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("status %v: %v", w.Code, w.Body)
+	}
+
+	var result HistoryResult
+	if err := json.Unmarshal(w.Body.Bytes(), &result); err != nil {
+		t.Fatal(err)
+	}
+	if len(result.Counters) != 1 || len(result.Counters["api.requests"]) != 2 || result.Counters["api.requests"][1].Timestamp != 110 {
+		t.Errorf("counters: %v", result.Counters)
+	}
+	if d := result.Dists["api.latency"]; len(d) != 2 || d[0].Mean != 10 || d[0].N != 1 {
+		t.Errorf("dists: %v", result.Dists)
+	}
+
+	w = httptest.NewRecorder()
+	NewHistoryJSON(h).ServeHTTP(w, httptest.NewRequest("GET", "/history.json?prefix=db.&from=0&to=200", nil))
+	result = HistoryResult{}
+	json.Unmarshal(w.Body.Bytes(), &result)
+	if len(result.Counters) != 1 || len(result.Counters["db.queries"]) != 2 {
+		t.Errorf("prefix counters: %v", result.Counters)
+	}
+
+	w = httptest.NewRecorder()
+	NewHistoryJSON(h).ServeHTTP(w, httptest.NewRequest("GET", "/history.json?resolution=1w", nil))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("expected bad request for unknown resolution, got %v", w.Code)
+	}
+}
+
+func Test_HistoryJSONEncodesNaNAsNull(t *testing.T) {
+	b, err := json.Marshal(HistoryDistPoint{Timestamp: 1, Mean: historyFloat(math.NaN()), N: 0})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != `{"Timestamp":1,"Mean":null,"Sd":0,"Min":0,"Max":0,"N":0}` {
+		t.Errorf("unexpected encoding %s", b)
+	}
+}
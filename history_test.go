@@ -0,0 +1,60 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+func Test_HistoryRollsUpAndRestores(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "stagger")
+	defer os.RemoveAll(dir)
+
+	retention := [4]time.Duration{time.Hour, time.Hour, time.Hour, time.Hour}
+	h, err := NewHistory(dir, retention)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	start := time.Now().Unix()
+	start -= start % 60
+	for i := int64(0); i < 7; i++ {
+		stats := NewTimestampedStats(start - 60 + i*10)
+		stats.AddCount(StatCount{"requests", 1, nil})
+		stats.AddValue(StatValue{Name: "latency", Value: float64(i)})
+		if err := h.add(stats); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	raw, _ := h.Query("raw", 0, start+60)
+	if len(raw) != 7 {
+		t.Errorf("expected 7 raw intervals, got %v", len(raw))
+	}
+
+	minutes, _ := h.Query("1m", 0, start+60)
+	if len(minutes) != 2 {
+		t.Fatalf("expected 2 minutes, got %v", len(minutes))
+	}
+	if minutes[0].Counters["requests"] != 6 || minutes[0].Dists["latency"].N != 6 || minutes[0].Dists["latency"].Max != 5 {
+		t.Errorf("unexpected first minute %v %v", minutes[0].Counters, minutes[0].Dists)
+	}
+	if minutes[1].Counters["requests"] != 1 {
+		t.Errorf("unexpected open minute %v", minutes[1].Counters)
+	}
+
+	// The open minute is rebuilt from the raw intervals after a restart
+	h, err = NewHistory(dir, retention)
+	if err != nil {
+		t.Fatal(err)
+	}
+	minutes, _ = h.Query("1m", start, start)
+	if len(minutes) != 1 || minutes[0].Counters["requests"] != 1 {
+		t.Errorf("expected open minute to be restored, got %v", minutes)
+	}
+
+	if _, err := h.Query("1w", 0, start); err == nil {
+		t.Error("expected error for unknown resolution")
+	}
+}
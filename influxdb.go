@@ -0,0 +1,206 @@
+// Output to InfluxDB using the line protocol, either POSTed over HTTP (to a /write URL such as http://localhost:8086/write?db=stagger) or sent over UDP (udp://localhost:8089). Each stat is a measurement tagged with the source; Dists are written as mean, sd, min, max, count and sum fields of one measurement.
+//
+// Writes which fail are kept and retried with the next interval, up to a limit.
+
+package main
+
+import (
+	"./httpclient"
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Lines kept for retry, beyond which the oldest are dropped
+const influxMaxBuffered = 100000
+
+// Largest UDP packet to send
+const influxMaxPacket = 1400
+
+var influxNameEscaper = strings.NewReplacer(",", `\,`, " ", `\ `)
+var influxTagEscaper = strings.NewReplacer(",", `\,`, " ", `\ `, "=", `\=`)
+
+type InfluxDB struct {
+	url        *url.URL
+	source     string
+	on_stats   chan *TimestampedStats
+	didStop    chan bool
+	httpclient *http.Client
+	buffered   []string
+}
+
+func NewInfluxDB(rawurl, source string) (*InfluxDB, error) {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" && u.Scheme != "udp" {
+		return nil, fmt.Errorf("unsupported influxdb url %v (expected http, https or udp)", rawurl)
+	}
+	return &InfluxDB{
+		url:    u,
+		source: source,
+		// Handle slow posts by combination of buffering channel & timing out
+		on_stats:   make(chan *TimestampedStats, 100),
+		didStop:    make(chan bool),
+		httpclient: httpclient.NewTimeoutClient(2 * time.Second),
+	}, nil
+}
+
+func (i *InfluxDB) Run() {
+	for stats := range i.on_stats {
+		i.buffered = append(i.buffered, i.lines(stats)...)
+		if over := len(i.buffered) - influxMaxBuffered; over > 0 {
+			info.Printf("[influxdb] Buffer full, dropping %v lines", over)
+			i.buffered = i.buffered[over:]
+		}
+		if len(i.buffered) == 0 {
+			debug.Print("[influxdb] No stats to report")
+			continue
+		}
+
+		var err error
+		if i.url.Scheme == "udp" {
+			err = i.sendUDP()
+		} else {
+			err = i.post()
+		}
+		if err != nil {
+			info.Printf("[influxdb] Error writing, will retry %v lines: %v", len(i.buffered), err)
+			continue
+		}
+		i.buffered = i.buffered[:0]
+	}
+	close(i.didStop)
+}
+
+func (i *InfluxDB) Send(stats *TimestampedStats) {
+	i.on_stats <- stats
+}
+
+// Stop writes any queued stats and returns once done. Lines which can't be
+// written by then are lost. Send must not be called afterwards
+func (i *InfluxDB) Stop() {
+	close(i.on_stats)
+	<-i.didStop
+}
+
+func (i *InfluxDB) lines(stats *TimestampedStats) []string {
+	tags := ""
+	if i.source != "" {
+		tags = ",source=" + influxTagEscaper.Replace(i.source)
+	}
+	ts := stats.Timestamp * int64(time.Second)
+
+	var lines []string
+	line := func(name string, fields map[string]float64) {
+		keys := make([]string, 0, len(fields))
+		for k, v := range fields {
+			// InfluxDB rejects the whole write for a NaN or infinite field,
+			// e.g. the mean of an empty Dist
+			if math.IsNaN(v) || math.IsInf(v, 0) {
+				continue
+			}
+			keys = append(keys, k)
+		}
+		if len(keys) == 0 {
+			return
+		}
+		sort.Strings(keys)
+		pairs := make([]string, len(keys))
+		for n, k := range keys {
+			pairs[n] = fmt.Sprintf("%v=%v", k, fields[k])
+		}
+		lines = append(lines, fmt.Sprintf("%v%v %v %v\n", influxNameEscaper.Replace(name), tags, strings.Join(pairs, ","), ts))
+	}
+
+	for key, value := range stats.Counters {
+		line(key, map[string]float64{"value": value})
+	}
+	for key, value := range stats.Dists {
+		line(key, map[string]float64{
+			"mean":  value.Mean(),
+			"sd":    value.Sd(),
+			"min":   value.Min,
+			"max":   value.Max,
+			"count": value.N,
+			"sum":   value.Sum_x,
+		})
+	}
+	for key, value := range stats.Histograms {
+		line(key, map[string]float64{
+			"p50":   value.P50(),
+			"p90":   value.P90(),
+			"p99":   value.P99(),
+			"count": value.N(),
+		})
+	}
+	sort.Strings(lines)
+	return lines
+}
+
+func (i *InfluxDB) post() error {
+	var b bytes.Buffer
+	for _, l := range i.buffered {
+		b.WriteString(l)
+	}
+
+	req, err := http.NewRequest("POST", i.url.String(), &b)
+	if err != nil {
+		return err
+	}
+	req.Header.Add("Content-Type", "text/plain")
+	if i.url.User != nil {
+		password, _ := i.url.User.Password()
+		req.SetBasicAuth(i.url.User.Username(), password)
+	}
+
+	resp, err := i.httpclient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode/100 != 2 {
+		body, _ := ioutil.ReadAll(resp.Body)
+		if resp.StatusCode/100 == 4 {
+			// The data itself was rejected, so retrying won't help
+			info.Printf("[influxdb] Write rejected (%v), dropping %v lines: %v", resp.StatusCode, len(i.buffered), string(body))
+			return nil
+		}
+		return fmt.Errorf("invalid response %v: %v", resp.StatusCode, string(body))
+	}
+	return nil
+}
+
+func (i *InfluxDB) sendUDP() error {
+	conn, err := net.Dial("udp", i.url.Host)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	// Send as many whole lines per packet as fit
+	var b bytes.Buffer
+	for n, l := range i.buffered {
+		if b.Len() > 0 && b.Len()+len(l) > influxMaxPacket {
+			if _, err := conn.Write(b.Bytes()); err != nil {
+				i.buffered = i.buffered[n:]
+				return err
+			}
+			b.Reset()
+		}
+		b.WriteString(l)
+	}
+	if _, err := conn.Write(b.Bytes()); err != nil {
+		return err
+	}
+	return nil
+}
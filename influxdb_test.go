@@ -0,0 +1,62 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func Test_InfluxDBWritesLineProtocol(t *testing.T) {
+	bodies := make(chan string, 1)
+	status := http.StatusServiceUnavailable
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path != "/write" || req.URL.Query().Get("db") != "stagger" {
+			t.Errorf("unexpected url %v", req.URL)
+		}
+		b, _ := ioutil.ReadAll(req.Body)
+		w.WriteHeader(status)
+		bodies <- string(b)
+	}))
+	defer server.Close()
+
+	i, err := NewInfluxDB(server.URL+"/write?db=stagger", "web 1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	stats := NewTimestampedStats(100)
+	stats.AddCount(StatCount{"requests", 3, nil})
+	stats.AddValue(StatValue{Name: "latency", Value: 10})
+	i.buffered = i.lines(stats)
+
+	expected := "latency,source=web\\ 1 count=1,max=10,mean=10,min=10,sd=0,sum=10 100000000000\n" +
+		"requests,source=web\\ 1 value=3 100000000000\n"
+
+	// A failed write is kept for retry
+	if err := i.post(); err == nil {
+		t.Error("expected error from unavailable server")
+	}
+	if body := <-bodies; body != expected {
+		t.Errorf("expected %q, got %q", expected, body)
+	}
+
+	status = http.StatusNoContent
+	if err := i.post(); err != nil {
+		t.Error(err)
+	}
+	if body := <-bodies; body != expected {
+		t.Errorf("expected %q on retry, got %q", expected, body)
+	}
+}
+
+func Test_InfluxDBSkipsNonFiniteFields(t *testing.T) {
+	i, _ := NewInfluxDB("udp://localhost:8089", "")
+	stats := NewTimestampedStats(1)
+	stats.Dists["empty"] = &Dist{}
+
+	lines := i.lines(stats)
+	if len(lines) != 1 || strings.Contains(lines[0], "NaN") || strings.Contains(lines[0], "Inf") {
+		t.Errorf("expected non-finite fields to be skipped, got %q", lines)
+	}
+}
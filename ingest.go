@@ -0,0 +1,46 @@
+// Accepts stats POSTed as JSON and pushes them into the interval currently being aggregated. The body has the same shape as a stats reply, e.g.
+//
+//     {"Values": [{"Name": "job.duration", "Value": 12.5, "Type": "ms"}], "Counts": [{"Name": "job.runs", "Count": 1}]}
+//
+// When a client certificate CA is configured, only requests authenticated with a client certificate are accepted.
+
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+)
+
+// Largest body accepted
+const maxIngestBody = 1 << 20
+
+type Ingest struct {
+	push        chan<- (*Stats)
+	requireCert bool
+}
+
+func NewIngest(push chan<- (*Stats), requireCert bool) *Ingest {
+	return &Ingest{push, requireCert}
+}
+
+func (i *Ingest) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.Method != "POST" {
+		w.Header().Set("Allow", "POST")
+		http.Error(w, "POST stats as JSON", http.StatusMethodNotAllowed)
+		return
+	}
+	if i.requireCert && (req.TLS == nil || len(req.TLS.VerifiedChains) == 0) {
+		http.Error(w, "Client certificate required", http.StatusForbidden)
+		return
+	}
+
+	var stats Stats
+	if err := json.NewDecoder(io.LimitReader(req.Body, maxIngestBody)).Decode(&stats); err != nil {
+		info.Printf("[ingest] Invalid body from %v: %v", req.RemoteAddr, err)
+		http.Error(w, "Invalid JSON: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	i.push <- &stats
+	w.WriteHeader(http.StatusAccepted)
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"crypto/tls"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func Test_IngestPushesStats(t *testing.T) {
+	push := make(chan *Stats, 1)
+	i := NewIngest(push, false)
+
+	body := `{"Values": [{"Name": "job.duration", "Value": 12.5, "Type": "ms"}], "Counts": [{"Name": "job.runs", "Count": 1}]}`
+	w := httptest.NewRecorder()
+	i.ServeHTTP(w, httptest.NewRequest("POST", "/ingest", strings.NewReader(body)))
+
+	if w.Code != http.StatusAccepted {
+		t.Fatalf("status %v", w.Code)
+	}
+	stats := <-push
+	if len(stats.Values) != 1 || stats.Values[0].Value != 12.5 || *stats.Values[0].Type != "ms" {
+		t.Errorf("values: %v", stats.Values)
+	}
+	if len(stats.Counts) != 1 || stats.Counts[0].Count != 1 {
+		t.Errorf("counts: %v", stats.Counts)
+	}
+}
+
+func Test_IngestRejectsInvalidRequests(t *testing.T) {
+	i := NewIngest(make(chan *Stats), true)
+
+	w := httptest.NewRecorder()
+	i.ServeHTTP(w, httptest.NewRequest("GET", "/ingest", nil))
+	if w.Code != http.StatusMethodNotAllowed {
+		t.Errorf("GET: status %v", w.Code)
+	}
+
+	w = httptest.NewRecorder()
+	i.ServeHTTP(w, httptest.NewRequest("POST", "/ingest", strings.NewReader("{}")))
+	if w.Code != http.StatusForbidden {
+		t.Errorf("no certificate: status %v", w.Code)
+	}
+
+	w = httptest.NewRecorder()
+	req := httptest.NewRequest("POST", "/ingest", strings.NewReader("nope"))
+	req.TLS = &tls.ConnectionState{}
+	NewIngest(make(chan *Stats), false).ServeHTTP(w, req)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("invalid body: status %v", w.Code)
+	}
+}
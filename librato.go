@@ -8,14 +8,24 @@ import (
 	"encoding/json"
 	"io/ioutil"
 	"net/http"
+	"regexp"
 	"time"
 )
 
+// Librato only accepts metric names made of these characters, which segment
+// keys may not respect
+var libratoInvalidName = regexp.MustCompile(`[^A-Za-z0-9.:_-]`)
+
+func libratoName(name string) string {
+	return libratoInvalidName.ReplaceAllString(name, "_")
+}
+
 type Librato struct {
 	source     string
 	email      string
 	token      string
 	on_stats   chan *TimestampedStats
+	didStop    chan bool
 	httpclient *http.Client
 }
 
@@ -26,6 +36,7 @@ func NewLibrato(source, email, token string) *Librato {
 		token:  token,
 		// Handle slow posts by combination of buffering channel & timing out
 		on_stats:   make(chan *TimestampedStats, 100),
+		didStop:    make(chan bool),
 		httpclient: httpclient.NewTimeoutClient(2 * time.Second),
 	}
 }
@@ -34,31 +45,39 @@ func (l *Librato) Run() {
 	var stats *TimestampedStats
 	for stats = range l.on_stats {
 		// Don't bother posting if there are no metrics (it's an error anyway)
-		if len(stats.Counters) == 0 && len(stats.Dists) == 0 {
+		if len(stats.Counters) == 0 && len(stats.Dists) == 0 && len(stats.Histograms) == 0 {
 			debug.Print("[librato] No stats to report")
 			continue
 		}
 
 		l.post(stats)
 	}
+	close(l.didStop)
 }
 
 func (l *Librato) Send(stats *TimestampedStats) {
 	l.on_stats <- stats
 }
 
+// Stop posts any queued stats and returns once done. Send must not be called
+// afterwards
+func (l *Librato) Stop() {
+	close(l.on_stats)
+	<-l.didStop
+}
+
 func (l *Librato) post(stats *TimestampedStats) {
 	gagues := make([]map[string]interface{}, 0)
 	for key, value := range stats.Counters {
 		gagues = append(gagues, map[string]interface{}{
-			"name":  key,
+			"name":  libratoName(key),
 			"value": value,
 		})
 	}
 
 	for key, value := range stats.Dists {
 		gagues = append(gagues, map[string]interface{}{
-			"name":        key,
+			"name":        libratoName(key),
 			"count":       value.N,
 			"sum":         value.Sum_x,
 			"sum_squares": value.Sum_x2,
@@ -67,6 +86,15 @@ func (l *Librato) post(stats *TimestampedStats) {
 		})
 	}
 
+	for key, value := range stats.Histograms {
+		for suffix, q := range map[string]float64{"p50": value.P50(), "p90": value.P90(), "p99": value.P99()} {
+			gagues = append(gagues, map[string]interface{}{
+				"name":  libratoName(key + "." + suffix),
+				"value": q,
+			})
+		}
+	}
+
 	data := map[string]interface{}{
 		"source":       l.source,
 		"measure_time": stats.Timestamp,
@@ -2,7 +2,6 @@ package main
 
 import (
 	"./pair"
-	"bytes"
 	"crypto/tls"
 	"crypto/x509"
 	"encoding/pem"
@@ -40,30 +39,10 @@ const info debugger = true
 var build string
 
 func main() {
-	hostname, _ := os.Hostname()
-	var source = flag.String("source", hostname, "source (for reporting)")
-	var interval = flag.Int("interval", 10, "stats interval (in seconds)")
-	var timeout = flag.Int("timeout", 1000, "receive timeout (in ms)")
-	var reg_addr = flag.String("registration", "tcp://127.0.0.1:5867", "address to which clients register")
-	var log_output = flag.Bool("log_output", true, "log aggregated data")
-	var librato_email = flag.String("librato_email", "", "librato email")
-	var librato_token = flag.String("librato_token", "", "librato token")
-	http_addr := flag.String("http", "127.0.0.1:8990", "HTTP debugging address (e.g. ':8990')")
-	https_addr := flag.String("https", "0.0.0.0:8443", "HTTPS address (e.g. ':8443')")
-	http_features_string := flag.String("features", "ws-json,http-json,sparkline", "HTTP features (ws-json,http-json,sparkline)")
-	ssl_crt := flag.String("crt", "", "SSL Certificate")
-	ssl_key := flag.String("key", "", "SSL Key")
-	ssl_ca := flag.String("ca", "", "Client certificate CA (If left unspecified, client certificates are not used)")
+	var config_path = flag.String("config", "", "YAML config file, reloaded on SIGHUP (flags given on the command line take precedence)")
 	var showBuild = flag.Bool("build", false, "Print build information")
+	DefaultConfig().RegisterFlags(flag.CommandLine)
 	flag.Parse()
-	http_features := make(map[string]bool)
-	for _, s := range strings.Split(*http_features_string, ",") {
-		http_features[s] = true
-	}
-	if *ssl_crt == "" || *ssl_key == "" {
-		*https_addr = ""
-		info.Printf("[main] Either SSL crt (%v) and key (%v) left unspecified, disabling https interface", *ssl_crt, *ssl_key)
-	}
 	if *showBuild {
 		if len(build) > 0 {
 			fmt.Println(build)
@@ -73,144 +52,177 @@ func main() {
 		os.Exit(0)
 	}
 
-	ts_complete := make(chan int64)
-	ts_new := make(chan int64)
-
-	ticker := NewTicker(*interval)
+	set_flags := map[string]string{}
+	flag.Visit(func(f *flag.Flag) {
+		set_flags[f.Name] = f.Value.String()
+	})
+	config, err := LoadConfig(*config_path, set_flags)
+	if err != nil {
+		log.Fatalf("[main] loading config: %v", err)
+	}
 
-	aggregator := NewAggregator()
-	go aggregator.Run(ts_complete, ts_new)
+	https_addr := config.HTTP.HTTPSAddr
+	if config.HTTP.Crt == "" || config.HTTP.Key == "" {
+		https_addr = ""
+		info.Printf("[main] Either SSL crt (%v) and key (%v) left unspecified, disabling https interface", config.HTTP.Crt, config.HTTP.Key)
+	}
 
-	client_manager := NewClientManager(aggregator)
-	go client_manager.Run(ticker, *timeout, ts_complete, ts_new)
+	schedule, err := ParseSurveySchedule(config.Survey)
+	if err != nil {
+		log.Fatalf("[main] %v", err)
+	}
 
-	pair_server := pair.NewServer(*reg_addr, pair.ServerDelegate(client_manager))
-	go pair_server.Run()
+	pair_transport, err := pair.TransportByName(config.Transport)
+	if err != nil {
+		log.Fatalf("[main] %v", err)
+	}
 
-	output := NewOutput()
+	// Aggregated stats to output, either from surveying clients or in relay
+	// mode from upstream staggers
+	var aggregated <-chan (*TimestampedStats)
+	var aggregator *Aggregator
+	var client_manager *ClientManager
+	var relay *Relay
+	var pair_server *pair.Server
+	var push chan<- (*Stats)
+
+	if config.Relay != "" {
+		if config.StatsD != "" {
+			log.Fatalf("[main] -statsd can't be used in relay mode")
+		}
+		relay = NewRelay(strings.Split(config.Relay, ","), time.Duration(config.RelayTimeout)*time.Millisecond)
+		go relay.Run()
+		aggregated = relay.output
+		info.Printf("[main] Relay mode, aggregating upstreams %v", config.Relay)
+	} else {
+		ts_complete := make(chan int64)
+		ts_new := make(chan int64)
+
+		aggregator = NewAggregator()
+		go aggregator.Run(ts_complete, ts_new)
+		aggregated = aggregator.output
+		push = aggregator.Push
+
+		client_manager = NewClientManager(aggregator, schedule, config.Interval)
+		go client_manager.Run(config.Timeout, ts_complete, ts_new)
+
+		if config.StatsD != "" {
+			statsd := NewStatsD(config.StatsD, aggregator.Push)
+			go statsd.Run()
+		}
 
-	if len(*librato_email) > 0 && len(*librato_token) > 0 {
-		librato := NewLibrato(*source, *librato_email, *librato_token)
-		go librato.Run()
-		output.Add(librato)
+		pair_server = pair.NewServer(config.Registration, pair.ServerDelegate(client_manager))
+		pair_server.SetTransport(pair_transport)
+		pair_server.SetHeartbeat(time.Duration(config.Heartbeat)*time.Millisecond, config.HeartbeatMissed)
+		go pair_server.Run()
 	}
 
-	if *log_output {
-		stdout := NewStdOut()
-		output.Add(stdout)
+	output := NewOutput()
+	reloader := NewReloader(output, client_manager, config, push, config.HTTP.Addr != "" || https_addr != "", config.HTTP.CA != "")
+	if err := reloader.Apply(config); err != nil {
+		log.Fatalf("[main] %v", err)
 	}
-	if *http_addr != "" || *https_addr != "" {
-		if _, ok := http_features["http-json"]; ok {
-			log.Println("[main] Http json enabled at http://" + *http_addr + "/snapshot.json")
-			snapshot := NewSnapshot()
-			output.Add(snapshot)
-			go func() {
-				http.Handle("/snapshot.json", snapshot)
-			}()
-		}
-		if _, ok := http_features["ws-json"]; ok {
-			log.Println("[main] Websocket json enabled at ws://" + *http_addr + "/ws.json")
-			websocketsender := NewWebsocketsender()
-			output.Add(websocketsender)
-			go func() {
-				http.Handle("/ws.json", websocketsender.GetWebsocketSenderHandler())
-			}()
-		}
-		if _, ok := http_features["sparkline"]; ok {
-			log.Println("[main] Sparkline enabled at http://" + *http_addr + "/spark.html")
-			js_data := []string{"/jquery.js",
-				"/jquery.sparkline.js",
-				"/jquery.appear.js",
-				"/jquery.jqplot.js",
-				"/jquery.jqplot.css",
-				"/reconnecting-websocket.js"}
-
-			for _, n := range js_data {
-				js, _ := Asset("sparkline" + n)
-				http.HandleFunc(n,
-					func(w http.ResponseWriter, req *http.Request) {
-						w.Header().Set("Content-Type", "application/javascript")
-						http.ServeContent(w, req, n, time.Time{}, bytes.NewReader(js))
-					})
-			}
-			hb, _ := Asset("sparkline/spark.html")
-			http.HandleFunc("/spark",
-				func(w http.ResponseWriter, req *http.Request) {
-					w.Header().Set("Content-Type", "text/html")
-					http.ServeContent(w, req, "spark", time.Time{}, bytes.NewReader(hb))
-				})
-			http.HandleFunc("/",
-				func(w http.ResponseWriter, req *http.Request) {
-					if req.URL.Path != "/" {
-						http.NotFound(w, req)
-						return
-					}
-					http.Redirect(w, req, "/spark", http.StatusFound)
-				})
 
+	if config.HTTP.Addr != "" {
+		go func() {
+			info.Printf("[main] HTTP server running on %v", config.HTTP.Addr)
+			log.Println(http.ListenAndServe(config.HTTP.Addr, reloader))
+		}()
+	}
+	if https_addr != "" {
+		cert, err := tls.LoadX509KeyPair(config.HTTP.Crt, config.HTTP.Key)
+		if err != nil {
+			log.Fatalf("[main] loading key/crt pair: %s", err)
 		}
-		if *http_addr != "" {
-			go func() {
-				info.Printf("[main] HTTP server running on %v", *http_addr)
-				log.Println(http.ListenAndServe(*http_addr, nil))
-			}()
-		}
-		if *https_addr != "" {
-			cert, err := tls.LoadX509KeyPair(*ssl_crt, *ssl_key)
+		cp := x509.NewCertPool()
+		var request_cert tls.ClientAuthType
+		if config.HTTP.CA != "" {
+			ca_data, err := ioutil.ReadFile(config.HTTP.CA)
 			if err != nil {
-				log.Fatalf("[main] loading key/crt pair: %s", err)
+				log.Fatalf("[main] loading ca: %s", err)
 			}
-			cp := x509.NewCertPool()
-			var request_cert tls.ClientAuthType
-			if *ssl_ca != "" {
-				ca_data, err := ioutil.ReadFile(*ssl_ca)
-				if err != nil {
-					log.Fatalf("[main] loading ca: %s", err)
-				}
-				ca_decoded, _ := pem.Decode(ca_data)
-				x509cert, err := x509.ParseCertificate(ca_decoded.Bytes)
-				if err != nil {
-					log.Fatalf("[main] ca not x509?, %s", err)
-				}
-				cp.AddCert(x509cert)
-				request_cert = tls.RequireAndVerifyClientCert
-			} else {
-				request_cert = tls.NoClientCert
-				log.Println("[main] WARNING: No client certificate specified, disabling authentication")
-			}
-			config := tls.Config{
-				Certificates:       []tls.Certificate{cert},
-				ClientAuth:         request_cert,
-				RootCAs:            cp,
-				ClientCAs:          cp,
-				InsecureSkipVerify: true, //Don't check hostname of client certificate
-				NextProtos:         []string{"http/1.1"},
-				CipherSuites: []uint16{ // Work around chrome ssl certificate issue
-					tls.TLS_RSA_WITH_RC4_128_SHA,
-					tls.TLS_RSA_WITH_3DES_EDE_CBC_SHA,
-					tls.TLS_RSA_WITH_AES_128_CBC_SHA,
-					tls.TLS_RSA_WITH_AES_256_CBC_SHA,
-				},
-			}
-			srv := http.Server{
-				Addr:      *https_addr,
-				TLSConfig: &config,
+			ca_decoded, _ := pem.Decode(ca_data)
+			x509cert, err := x509.ParseCertificate(ca_decoded.Bytes)
+			if err != nil {
+				log.Fatalf("[main] ca not x509?, %s", err)
 			}
-			go func() {
-				info.Printf("[main] HTTPS server running on %v", *https_addr)
-				log.Println(srv.ListenAndServeTLS(*ssl_crt, *ssl_key))
-			}()
+			cp.AddCert(x509cert)
+			request_cert = tls.RequireAndVerifyClientCert
+		} else {
+			request_cert = tls.NoClientCert
+			log.Println("[main] WARNING: No client certificate specified, disabling authentication")
 		}
+		tls_config := tls.Config{
+			Certificates:       []tls.Certificate{cert},
+			ClientAuth:         request_cert,
+			RootCAs:            cp,
+			ClientCAs:          cp,
+			InsecureSkipVerify: true, //Don't check hostname of client certificate
+			NextProtos:         []string{"http/1.1"},
+			CipherSuites: []uint16{ // Work around chrome ssl certificate issue
+				tls.TLS_RSA_WITH_RC4_128_SHA,
+				tls.TLS_RSA_WITH_3DES_EDE_CBC_SHA,
+				tls.TLS_RSA_WITH_AES_128_CBC_SHA,
+				tls.TLS_RSA_WITH_AES_256_CBC_SHA,
+			},
+		}
+		srv := http.Server{
+			Addr:      https_addr,
+			Handler:   reloader,
+			TLSConfig: &tls_config,
+		}
+		go func() {
+			info.Printf("[main] HTTPS server running on %v", https_addr)
+			log.Println(srv.ListenAndServeTLS(config.HTTP.Crt, config.HTTP.Key))
+		}()
 	}
 
-	go output.Run(aggregator.output)
+	go output.Run(aggregated)
 
 	info.Printf("[main] Stagger running")
 
-	// Handle termination
+	// Reload the config on SIGHUP, until terminated
 	c := make(chan os.Signal, 1)
-	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
-	<-c
-	pair_server.Shutdown()
-	info.Print("[main] Exiting cleanly")
+	signal.Notify(c, os.Interrupt, syscall.SIGTERM, syscall.SIGHUP)
+	for sig := range c {
+		if sig != syscall.SIGHUP {
+			break
+		}
+		info.Printf("[main] Reloading config %v", *config_path)
+		reloaded, err := LoadConfig(*config_path, set_flags)
+		if err != nil {
+			info.Printf("[main] Error reloading config, keeping current: %v", err)
+			continue
+		}
+		if reloaded.Static() != config.Static() {
+			info.Print("[main] WARNING: Only the survey settings, source, outputters and HTTP features can be reloaded, restart to apply other changes")
+		}
+		if err := reloader.Apply(reloaded); err != nil {
+			info.Printf("[main] Error reloading: %v", err)
+		}
+	}
+
+	// Shut down in order, so that stats since the last tick are output
+	info.Print("[main] Shutting down, send another signal to exit immediately")
+	go func() {
+		<-c
+		log.Fatal("[main] Exiting without finishing shutdown")
+	}()
+	if client_manager != nil {
+		client_manager.Shutdown()
+	}
+	if pair_server != nil {
+		pair_server.Shutdown()
+		client_manager.Close()
+	}
+	if aggregator != nil {
+		aggregator.Shutdown()
+	} else {
+		relay.Shutdown()
+	}
+	if output.Stop(time.Duration(config.ShutdownTimeout) * time.Millisecond) {
+		info.Print("[main] Exiting cleanly")
+	} else {
+		info.Print("[main] Exiting, some stats may not have been output")
+	}
 }
@@ -1,53 +1,115 @@
-// Output receives aggregated data from the aggregator and exposes it to downstream stagger processes, to any other process which wishes to subscribe to data via ZMQ, and to all configured outputters
+// Output receives aggregated data from the aggregator and passes it to all configured outputters
+//
+// Outputters are registered by name so that they can be replaced or removed while running, e.g. when the config is reloaded.
+//
+// Run returns once the aggregated data channel is closed on shutdown, after which Stop gives the outputters a deadline to output what they have queued.
 
 package main
 
 import (
-	zmq "github.com/pebbe/zmq4"
+	"sort"
+	"strings"
+	"sync"
+	"time"
 )
 
-type OutputStat struct {
-	Timestamp int64
-	Dist      *Dist
-}
-
 type Outputter interface {
 	Send(*TimestampedStats)
 }
 
+// Outputters which queue stats or hold connections or files implement
+// Stopper. Stop should output anything queued and release resources before
+// returning
+type Stopper interface {
+	Stop()
+}
+
+type namedOutputter struct {
+	name string
+	op   Outputter
+}
+
 type Output struct {
-	outputs []Outputter
+	mutex   sync.Mutex
+	outputs []namedOutputter
+	didRun  chan bool
 }
 
 func NewOutput() *Output {
-	return &Output{[]Outputter{}}
+	return &Output{didRun: make(chan bool)}
 }
 
 func (o *Output) Run(complete_chan <-chan (*TimestampedStats)) {
-	pub, _ := zmq.NewSocket(zmq.PUB)
+	for stats := range complete_chan {
+		o.mutex.Lock()
+		for _, n := range o.outputs {
+			n.op.Send(stats)
+		}
+		o.mutex.Unlock()
+	}
+	close(o.didRun)
+}
 
-	pub.Bind("tcp://*:5563")
+// Stop waits for Run to return, then stops every outputter concurrently. It
+// returns false if they haven't all stopped within timeout
+func (o *Output) Stop(timeout time.Duration) bool {
+	deadline := time.After(timeout)
+	select {
+	case <-o.didRun:
+	case <-deadline:
+		info.Print("[output] Timed out waiting for the final stats")
+		return false
+	}
 
-	for stats := range complete_chan {
-		// ZMQ pubsub
-		// TODO: Extract as outputter
-		for key, value := range stats.Dists {
-			output_stat := OutputStat{stats.Timestamp, value}
-
-			if b, err := marshal(output_stat); err == nil {
-				pub.Send(key, zmq.SNDMORE) // Use stat name as channel?
-				pub.SendBytes(b, 0)
-			} else {
-				info.Printf("Error encoding as msgpack: %v", output_stat)
-			}
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	stopping := map[string]bool{}
+	stopped := make(chan string, len(o.outputs))
+	for _, n := range o.outputs {
+		if s, ok := n.op.(Stopper); ok {
+			stopping[n.name] = true
+			go func(name string, s Stopper) {
+				s.Stop()
+				stopped <- name
+			}(n.name, s)
 		}
+	}
 
-		for _, op := range o.outputs {
-			op.Send(stats)
+	for len(stopping) > 0 {
+		select {
+		case name := <-stopped:
+			debug.Printf("[output] Stopped %v", name)
+			delete(stopping, name)
+		case <-deadline:
+			names := make([]string, 0, len(stopping))
+			for name := range stopping {
+				names = append(names, name)
+			}
+			sort.Strings(names)
+			info.Printf("[output] Timed out waiting for %v to stop", strings.Join(names, ", "))
+			return false
 		}
 	}
+	return true
 }
 
-func (o *Output) Add(op Outputter) {
-	o.outputs = append(o.outputs, op)
+// Add registers an outputter under name, which must not already be in use
+func (o *Output) Add(name string, op Outputter) {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	o.outputs = append(o.outputs, namedOutputter{name, op})
+}
+
+// Remove unregisters and returns the outputter with the given name, or nil.
+// It is not stopped, but no more stats will be sent to it
+func (o *Output) Remove(name string) Outputter {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	for i, n := range o.outputs {
+		if n.name == name {
+			o.outputs = append(o.outputs[:i], o.outputs[i+1:]...)
+			return n.op
+		}
+	}
+	return nil
 }
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+type slowOutputter struct {
+	delay   time.Duration
+	stopped chan bool // closed once stopped
+}
+
+func newSlowOutputter(delay time.Duration) *slowOutputter {
+	return &slowOutputter{delay, make(chan bool)}
+}
+
+func (s *slowOutputter) Send(stats *TimestampedStats) {}
+
+func (s *slowOutputter) Stop() {
+	time.Sleep(s.delay)
+	close(s.stopped)
+}
+
+func Test_OutputStopWaitsForOutputters(t *testing.T) {
+	o := NewOutput()
+	fast := newSlowOutputter(time.Millisecond)
+	o.Add("fast", fast)
+	c := make(chan *TimestampedStats)
+	go o.Run(c)
+	close(c)
+	if !o.Stop(time.Second) {
+		t.Error("expected outputter to be stopped")
+	}
+	select {
+	case <-fast.stopped:
+	default:
+		t.Error("expected outputter to have stopped before Stop returned")
+	}
+
+	o = NewOutput()
+	o.Add("slow", newSlowOutputter(time.Second))
+	c = make(chan *TimestampedStats)
+	go o.Run(c)
+	close(c)
+	if o.Stop(10 * time.Millisecond) {
+		t.Error("expected stop to time out")
+	}
+}
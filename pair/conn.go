@@ -1,15 +1,21 @@
 package pair
 
 import (
-	zmq "github.com/pebbe/zmq4"
+	"time"
 )
 
 type Conn struct {
 	OnMethod      chan zmqMessage
 	OnClose       chan bool
 	sendMessage   chan zmqMessage
+	sigClose      chan bool
+	didClose      chan bool
+	didRelease    chan bool
+	transport     Transport
 	addr          string
 	shouldConnect bool
+	heartbeat     time.Duration
+	maxMissed     int
 }
 
 type zmqMessage struct {
@@ -17,52 +23,89 @@ type zmqMessage struct {
 	Params []byte
 }
 
-// NewConn creates a Connection. You must select on OnMethod and OnClose
-func NewConn() *Conn {
-	return &Conn{make(chan zmqMessage), make(chan bool), make(chan zmqMessage, 1), "", false}
+// NewConn creates a Connection over the given transport. You must select on
+// OnMethod and OnClose
+func NewConn(t Transport) *Conn {
+	return &Conn{make(chan zmqMessage), make(chan bool), make(chan zmqMessage, 1), make(chan bool, 1), make(chan bool), make(chan bool), t, "", false, 0, 0}
 }
 
-// ShouldConnect notifies the Connection that it should Connect when Run called
+// SetHeartbeat makes the Connection send pair:ping every period, and close
+// when maxMissed pings in a row have not been answered with pair:pong. A zero
+// period disables heartbeats. A maxMissed below 1 keeps sending pings but
+// never closes the Connection for missing pongs.
+func (c *Conn) SetHeartbeat(period time.Duration, maxMissed int) {
+	c.heartbeat = period
+	c.maxMissed = maxMissed
+}
+
+// ShouldConnect notifies the Connection that it should Connect when Run called.
+// Addresses prefixed with framed+ override the Connection's transport
 func (c *Conn) ShouldConnect(addr string) {
-	c.addr = addr
+	c.transport, c.addr = resolveAddress(addr, c.transport)
 	c.shouldConnect = true
 }
 
-// Send sends a message to the Connection
+// Send sends a message to the Connection. Messages sent once it has closed
+// are dropped
 func (c *Conn) Send(method string, params []byte) {
-	c.sendMessage <- zmqMessage{method, params}
+	select {
+	case c.sendMessage <- zmqMessage{method, params}:
+	case <-c.didClose:
+	}
+}
+
+// Released is closed once the Connection's socket has been closed, which may be
+// up to a read timeout after the Connection itself closes, or once Run returns
+// if it never opened one
+func (c *Conn) Released() <-chan bool {
+	return c.didRelease
+}
+
+// Close closes the Connection without notifying the remote peer. OnClose is
+// signalled as if the peer had gone away.
+func (c *Conn) Close() {
+	select {
+	case c.sigClose <- true:
+	default:
+	}
 }
 
 func (c *Conn) Run() {
 	recvMessage := make(chan ([][]byte), 1)
+	peerClosed := make(chan bool, 1)
 	shouldClose := false
+	dialled := false
 
-	pair, _ := zmq.NewSocket(zmq.PAIR)
+	// OnClose is signalled however Run returns, including when it fails to
+	// connect, so that the client is removed
+	defer func() {
+		shouldClose = true
+		close(c.didClose)
+		if !dialled {
+			close(c.didRelease)
+		}
+		c.OnClose <- true
+	}()
 
-	// Set a HWM to force an error when sending, thereby detecting that the
-	// client has gone away
-	if err := pair.SetSndhwm(1); err != nil {
-		info.Printf("[pair] Error in SetSndhwm: %v", err)
+	if !c.shouldConnect {
+		info.Printf("[pair] No address to connect to")
 		return
 	}
 
-	// Timeout reads after 61s so that this goroutine can close
-	if err := pair.SetRcvtimeo(9e9); err != nil {
-		info.Printf("[pair] Error in SetRcvtimeo: %v", err)
+	// Timeout reads after 1s so that this goroutine can close, and release
+	// the socket promptly for a Connection replacing this one
+	pair, err := c.transport.Dial(c.addr, time.Second)
+	if err != nil {
+		info.Printf("[pair] Error connecting to client: %v", err)
 		return
 	}
+	dialled = true
 
-	if c.shouldConnect {
-		if err := pair.Connect(c.addr); err != nil {
-			info.Printf("[pair] Error connecting to client: %v", err)
-			return
-		}
-	}
-
-	// Goroutine handles reading from zmq
+	// Goroutine handles reading from the socket
 	go func() {
+		defer close(c.didRelease)
 		for {
-			parts, err := pair.RecvMessageBytes(0)
+			parts, err := pair.Recv()
 
 			if shouldClose {
 				debug.Printf("[pair] Closing pair socket")
@@ -70,33 +113,53 @@ func (c *Conn) Run() {
 				return
 			}
 
+			if err == errSocketClosed {
+				peerClosed <- true
+				return
+			}
+
 			if err == nil {
 				recvMessage <- parts
 			}
 		}
 	}()
 
-	defer func() {
-		shouldClose = true
-		c.OnClose <- true
-	}()
-
 	// send method for use by this goroutine
-	send := func(method string, params []byte) (err error) {
-		// Note: I considered using the cleaner pair.SendMessage but
-		// unfortunately that doesn't currently support arbitrary flags
-		// Using DONTWAIT to avoid Send blocking when HWM is reached
-		if _, err = pair.Send(method, zmq.DONTWAIT|zmq.SNDMORE); err != nil {
-			return
-		}
-		if _, err = pair.SendBytes(params, zmq.DONTWAIT); err != nil {
-			return
-		}
-		return
+	send := func(method string, params []byte) error {
+		return pair.Send([]byte(method), params)
+	}
+
+	// Pings sent since the last pong
+	missed := 0
+	var heartbeat <-chan time.Time
+	if c.heartbeat > 0 {
+		ticker := time.NewTicker(c.heartbeat)
+		defer ticker.Stop()
+		heartbeat = ticker.C
 	}
 
 	for {
 		select {
+		case <-c.sigClose:
+			debug.Printf("[pair] Closing %v", c.addr)
+			return
+
+		case <-peerClosed:
+			info.Printf("[pair] Connection to %v closed by peer", c.addr)
+			return
+
+		case <-heartbeat:
+			if c.maxMissed > 0 && missed >= c.maxMissed {
+				info.Printf("[pair] Closing %v after %v missed pongs", c.addr, missed)
+				return
+			}
+			debug.Print("[pair] Sending ping")
+			if err := send("pair:ping", []byte("")); err != nil {
+				info.Printf("[pair] Closing %v after err: %v", c.addr, err)
+				return
+			}
+			missed += 1
+
 		case msg := <-c.sendMessage:
 			if err := send(msg.Method, msg.Params); err != nil {
 				info.Printf("[pair] Closing %v after err: %v", c.addr, err)
@@ -111,7 +174,7 @@ func (c *Conn) Run() {
 				send("pair:pong", []byte(""))
 			} else if s == "pair:pong" {
 				debug.Print("[pair] Received pong")
-				// Do nothing
+				missed = 0
 			} else if s == "pair:shutdown" {
 				info.Print("[pair] Remote peer sent shutdown message")
 				return
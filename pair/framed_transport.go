@@ -0,0 +1,217 @@
+// The framed transport carries the same multipart messages as ZeroMQ over plain TCP or unix sockets. Each message is written as a big endian uint32 part count, followed by each part as a big endian uint32 length and its bytes.
+//
+// Registrations are sent by connecting to the registration address and writing one message per registration, after which the connection MAY be closed. For pair connections the client listens on its registered address and the server connects to it.
+
+package pair
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Largest part and most parts accepted, to guard against garbage on the socket
+const maxFramePart = 64 << 20
+const maxFrameParts = 16
+
+// Sends which can't be written within this time fail, as with the zmq HWM
+const framedSendTimeout = 100 * time.Millisecond
+
+var errRecvTimeout = errors.New("receive timeout")
+var errSocketClosed = errors.New("socket closed")
+
+type FramedTransport struct{}
+
+// framedNetwork maps tcp://, unix:// and ipc:// addresses to a net network
+func framedNetwork(addr string) (network, address string, err error) {
+	for _, scheme := range []string{"tcp", "unix", "ipc"} {
+		if strings.HasPrefix(addr, scheme+"://") {
+			address = strings.TrimPrefix(addr, scheme+"://")
+			if scheme == "tcp" {
+				// Accept zmq style wildcard binds
+				address = strings.Replace(address, "*", "", 1)
+				return "tcp", address, nil
+			}
+			return "unix", address, nil
+		}
+	}
+	return "", "", fmt.Errorf("unsupported framed address %v", addr)
+}
+
+func writeFrame(w io.Writer, parts [][]byte) error {
+	buf := make([]byte, 4, 4+len(parts)*4)
+	binary.BigEndian.PutUint32(buf, uint32(len(parts)))
+	for _, part := range parts {
+		var l [4]byte
+		binary.BigEndian.PutUint32(l[:], uint32(len(part)))
+		buf = append(buf, l[:]...)
+		buf = append(buf, part...)
+	}
+	_, err := w.Write(buf)
+	return err
+}
+
+func readFrame(r io.Reader) ([][]byte, error) {
+	var l [4]byte
+	if _, err := io.ReadFull(r, l[:]); err != nil {
+		return nil, err
+	}
+	n := binary.BigEndian.Uint32(l[:])
+	if n > maxFrameParts {
+		return nil, fmt.Errorf("frame has too many parts (%v)", n)
+	}
+	parts := make([][]byte, n)
+	for i := range parts {
+		if _, err := io.ReadFull(r, l[:]); err != nil {
+			return nil, err
+		}
+		size := binary.BigEndian.Uint32(l[:])
+		if size > maxFramePart {
+			return nil, fmt.Errorf("frame part too large (%v bytes)", size)
+		}
+		parts[i] = make([]byte, size)
+		if _, err := io.ReadFull(r, parts[i]); err != nil {
+			return nil, err
+		}
+	}
+	return parts, nil
+}
+
+// framedSocket delivers messages read from one or more connections on a
+// channel, so that Recv can time out without losing frame alignment
+type framedSocket struct {
+	messages chan [][]byte
+	closed   chan bool
+	timeout  time.Duration
+	listener net.Listener
+	conn     net.Conn // set for pair sockets
+	mutex    sync.Mutex
+	conns    map[net.Conn]bool
+}
+
+func newFramedSocket(timeout time.Duration) *framedSocket {
+	return &framedSocket{
+		messages: make(chan [][]byte),
+		closed:   make(chan bool),
+		timeout:  timeout,
+		conns:    make(map[net.Conn]bool),
+	}
+}
+
+func (FramedTransport) Listen(addr string, timeout time.Duration) (Socket, error) {
+	network, address, err := framedNetwork(addr)
+	if err != nil {
+		return nil, err
+	}
+	listener, err := net.Listen(network, address)
+	if err != nil {
+		return nil, err
+	}
+	s := newFramedSocket(timeout)
+	s.listener = listener
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go s.read(conn)
+		}
+	}()
+	return s, nil
+}
+
+func (FramedTransport) Dial(addr string, timeout time.Duration) (Socket, error) {
+	network, address, err := framedNetwork(addr)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := net.DialTimeout(network, address, timeout)
+	if err != nil {
+		return nil, err
+	}
+	s := newFramedSocket(timeout)
+	s.conn = conn
+	go s.read(conn)
+	return s, nil
+}
+
+func (s *framedSocket) read(conn net.Conn) {
+	s.mutex.Lock()
+	s.conns[conn] = true
+	s.mutex.Unlock()
+	defer func() {
+		conn.Close()
+		s.mutex.Lock()
+		delete(s.conns, conn)
+		s.mutex.Unlock()
+		// The peer of a pair socket going away closes the socket
+		if conn == s.conn {
+			s.Close()
+		}
+	}()
+
+	r := bufio.NewReader(conn)
+	for {
+		parts, err := readFrame(r)
+		if err != nil {
+			if err != io.EOF {
+				debug.Printf("[pair-framed] Read error from %v: %v", conn.RemoteAddr(), err)
+			}
+			return
+		}
+		select {
+		case s.messages <- parts:
+		case <-s.closed:
+			return
+		}
+	}
+}
+
+func (s *framedSocket) Recv() ([][]byte, error) {
+	select {
+	case parts := <-s.messages:
+		return parts, nil
+	case <-s.closed:
+		return nil, errSocketClosed
+	case <-time.After(s.timeout):
+		return nil, errRecvTimeout
+	}
+}
+
+func (s *framedSocket) Send(parts ...[]byte) error {
+	if s.conn == nil {
+		return errors.New("cannot send on a registration socket")
+	}
+	select {
+	case <-s.closed:
+		return errSocketClosed
+	default:
+	}
+	s.conn.SetWriteDeadline(time.Now().Add(framedSendTimeout))
+	return writeFrame(s.conn, parts)
+}
+
+func (s *framedSocket) Close() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	select {
+	case <-s.closed:
+		return nil
+	default:
+	}
+	close(s.closed)
+	if s.listener != nil {
+		s.listener.Close()
+	}
+	for conn := range s.conns {
+		conn.Close()
+	}
+	return nil
+}
@@ -0,0 +1,107 @@
+package pair
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func Test_FramedRegistration(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "stagger")
+	defer os.RemoveAll(dir)
+	addr := "unix://" + filepath.Join(dir, "reg.sock")
+
+	s, err := FramedTransport{}.Listen(addr, 500*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	conn, err := net.Dial("unix", filepath.Join(dir, "reg.sock"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeFrame(conn, [][]byte{[]byte("tcp://127.0.0.1:1234"), []byte("name=worker")})
+	conn.Close()
+
+	parts, err := s.Recv()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(parts) != 2 || string(parts[0]) != "tcp://127.0.0.1:1234" || string(parts[1]) != "name=worker" {
+		t.Errorf("unexpected registration %q", parts)
+	}
+}
+
+func Test_FramedPair(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	s, err := FramedTransport{}.Dial("tcp://"+l.Addr().String(), 500*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	peer, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s.Send([]byte("pair:ping"), []byte("")); err != nil {
+		t.Fatal(err)
+	}
+	parts, err := readFrame(peer)
+	if err != nil || len(parts) != 2 || string(parts[0]) != "pair:ping" {
+		t.Errorf("unexpected message %q (%v)", parts, err)
+	}
+
+	writeFrame(peer, [][]byte{[]byte("pair:pong"), []byte("")})
+	if parts, err := s.Recv(); err != nil || string(parts[0]) != "pair:pong" {
+		t.Errorf("unexpected message %q (%v)", parts, err)
+	}
+
+	if _, err := s.Recv(); err != errRecvTimeout {
+		t.Errorf("expected timeout, got %v", err)
+	}
+
+	peer.Close()
+	if _, err := s.Recv(); err != errSocketClosed {
+		t.Errorf("expected closed socket, got %v", err)
+	}
+}
+
+func Test_FramedRejectsTooManyParts(t *testing.T) {
+	if _, err := readFrame(bytes.NewReader([]byte{0xff, 0xff, 0xff, 0xff})); err == nil {
+		t.Error("expected an error for a bogus part count")
+	}
+}
+
+func Test_ConnClosesWhenDialFails(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "pair")
+	defer os.RemoveAll(dir)
+
+	c := NewConn(FramedTransport{})
+	c.ShouldConnect("unix://" + filepath.Join(dir, "missing.sock"))
+	go c.Run()
+
+	select {
+	case <-c.OnClose:
+	case <-time.After(time.Second):
+		t.Fatal("expected OnClose after failing to connect")
+	}
+	select {
+	case <-c.Released():
+	default:
+		t.Error("expected a Connection which never connected to be released")
+	}
+	// Sends after closing don't block
+	c.Send("report_all", nil)
+	c.Send("report_all", nil)
+}
@@ -1,46 +1,138 @@
 package pair
 
 import (
-	zmq "github.com/pebbe/zmq4"
+	"fmt"
+	"net/url"
 	"os"
+	"strconv"
+	"strings"
 	"time"
 )
 
+// Clients which don't declare a protocol version are assumed to speak the
+// original protocol, with no optional capabilities
+const LegacyVersion = 1
+
+// Meta describes a registered client. It is sent as the second part of the
+// registration message, either as a plain name or url encoded, e.g.
+// name=worker&pid=123&hostname=web1&app=api&version=2&capabilities=report_list,histograms&interval=60
+type Meta struct {
+	Name         string
+	Pid          string
+	Hostname     string
+	App          string
+	Version      int
+	Capabilities []string
+	Interval     int // requested survey interval in seconds, 0 for every tick
+}
+
+func ParseMeta(s string) Meta {
+	if !strings.Contains(s, "=") {
+		return Meta{Name: s, Version: LegacyVersion}
+	}
+	values, err := url.ParseQuery(s)
+	if err != nil {
+		info.Printf("[pair-reg] Invalid registration metadata %q: %v", s, err)
+		return Meta{Name: s, Version: LegacyVersion}
+	}
+	m := Meta{
+		Name:     values.Get("name"),
+		Pid:      values.Get("pid"),
+		Hostname: values.Get("hostname"),
+		App:      values.Get("app"),
+		Version:  LegacyVersion,
+	}
+	if v := values.Get("version"); v != "" {
+		if m.Version, err = strconv.Atoi(v); err != nil {
+			info.Printf("[pair-reg] Invalid protocol version %q, assuming %v", v, LegacyVersion)
+			m.Version = LegacyVersion
+		}
+	}
+	if v := values.Get("interval"); v != "" {
+		if m.Interval, err = strconv.Atoi(v); err != nil || m.Interval < 0 {
+			info.Printf("[pair-reg] Invalid survey interval %q, ignoring", v)
+			m.Interval = 0
+		}
+	}
+	for _, c := range strings.Split(values.Get("capabilities"), ",") {
+		if c != "" {
+			m.Capabilities = append(m.Capabilities, c)
+		}
+	}
+	return m
+}
+
+// Supports returns whether the client declared the capability
+func (m Meta) Supports(capability string) bool {
+	for _, c := range m.Capabilities {
+		if c == capability {
+			return true
+		}
+	}
+	return false
+}
+
+func (m Meta) String() string {
+	var parts []string
+	if m.Name != "" {
+		parts = append(parts, m.Name)
+	}
+	if m.App != "" {
+		parts = append(parts, "app:"+m.App)
+	}
+	if m.Pid != "" && m.Hostname != "" {
+		parts = append(parts, fmt.Sprintf("pid:%v@%v", m.Pid, m.Hostname))
+	} else if m.Pid != "" {
+		parts = append(parts, "pid:"+m.Pid)
+	} else if m.Hostname != "" {
+		parts = append(parts, "host:"+m.Hostname)
+	}
+	return strings.Join(parts, " ")
+}
+
+// A registration received from a client, and the transport over which it was
+// received
+type RegMessage struct {
+	Address   string
+	Meta      Meta
+	Transport Transport
+}
+
 type Registration struct {
 	address       string
-	Registrations chan string
+	transport     Transport
+	Registrations chan RegMessage
 	sigClose      chan bool
 	didClose      chan bool
 }
 
-func NewRegistration(a string) *Registration {
-	return &Registration{a, make(chan string), make(chan bool), make(chan bool)}
+func NewRegistration(a string, t Transport) *Registration {
+	t, a = resolveAddress(a, t)
+	return &Registration{a, t, make(chan RegMessage), make(chan bool), make(chan bool)}
 }
 
 func (r *Registration) Run() {
 	recvMessage := make(chan ([]string))
 	shouldClose := false
 
-	// Goroutine handles all zmq interactions
+	// Goroutine handles all socket interactions
 	go func() {
-		pull, _ := zmq.NewSocket(zmq.PULL)
-
 		// It's necesssary to timeout so that we can close the registration
 		// channel cleanly _before_ disconnecting clients. This ensures that
 		// re-registrations aren't received by the dying process.
-		if err := pull.SetRcvtimeo(500 * time.Millisecond); err != nil {
-			info.Printf("[pair-reg] Error in SetRcvtimeo: %v", err)
-			return
-		}
-
-		if err := pull.Bind(r.address); err != nil {
+		pull, err := r.transport.Listen(r.address, 500*time.Millisecond)
+		if err != nil {
 			info.Printf("[pair-reg] Error binding to %v: %v", r.address, err)
 			os.Exit(1)
 		}
 
 		for {
-			if parts, err := pull.RecvMessage(0); err == nil {
-				recvMessage <- parts
+			if parts, err := pull.Recv(); err == nil {
+				strs := make([]string, len(parts))
+				for i, p := range parts {
+					strs[i] = string(p)
+				}
+				recvMessage <- strs
 			}
 			if shouldClose {
 				pull.Close() // blocks until closed
@@ -56,8 +148,7 @@ func (r *Registration) Run() {
 			if len(parts) != 2 {
 				info.Printf("[pair-reg] Invalid reg, should have 2 parts")
 			} else {
-				// TODO: Use the 2nd part
-				r.Registrations <- parts[0]
+				r.Registrations <- RegMessage{parts[0], ParseMeta(parts[1]), r.transport}
 			}
 		case <-r.sigClose:
 			shouldClose = true
@@ -11,6 +11,9 @@ type Server struct {
 	ServerDelegate
 	sigShutdown chan bool
 	didShutdown chan bool
+	heartbeat   time.Duration
+	maxMissed   int
+	transport   Transport
 }
 
 type Pairable interface {
@@ -21,40 +24,91 @@ type Pairable interface {
 type ServerDelegate interface {
 	AddClient(interface{})
 	RemoveClient(interface{})
-	NewClient(id int, pc *Conn) Pairable
+	// Called instead of RemoveClient & AddClient when a client re-registers
+	// from an address which is already connected
+	ReplaceClient(old, new interface{})
+	NewClient(id int, pc *Conn, meta Meta) Pairable
 }
 
 func NewServer(reg_addr string, d ServerDelegate) *Server {
-	return &Server{reg_addr, d, make(chan bool), make(chan bool)}
+	return &Server{reg_addr, d, make(chan bool), make(chan bool), 0, 0, ZmqTransport{}}
+}
+
+// SetTransport sets the default transport, used for the registration address
+// and client connections unless their address selects another
+func (self *Server) SetTransport(t Transport) {
+	self.transport = t
+}
+
+// SetHeartbeat configures heartbeats for all connections created after it is
+// called (see Conn.SetHeartbeat)
+func (self *Server) SetHeartbeat(period time.Duration, maxMissed int) {
+	self.heartbeat = period
+	self.maxMissed = maxMissed
 }
 
 func (self *Server) Run() {
-	registration := NewRegistration(self.reg_addr)
+	registration := NewRegistration(self.reg_addr, self.transport)
 	go registration.Run()
 
 	idIncr := 0
 	clients := make(map[int]Pairable)
+	conns := make(map[int]*Conn)
+	// Registered address of each client, used to dedupe re-registrations
+	addrs := make(map[string]int)
 
 	// Clients send a message on this channel when they go away
 	clientDidClose := make(chan int)
 
 	for {
 		select {
-		case addr := <-registration.Registrations:
-			pc := NewConn()
-			pc.ShouldConnect(addr)
-			go pc.Run()
-
+		case reg := <-registration.Registrations:
 			idIncr += 1
-			client := self.NewClient(idIncr, pc)
+			oldId, replacing := addrs[reg.Address]
+
+			pc := NewConn(reg.Transport)
+			pc.ShouldConnect(reg.Address)
+			pc.SetHeartbeat(self.heartbeat, self.maxMissed)
+			if replacing {
+				// Only connect once the old socket is closed, so that two
+				// pair sockets are never connected to the same peer
+				info.Printf("[pair-server] %v re-registered, replacing client %v with %v", reg.Address, oldId, idIncr)
+				old := conns[oldId]
+				old.Close()
+				go func() {
+					<-old.Released()
+					pc.Run()
+				}()
+			} else {
+				go pc.Run()
+			}
+
+			client := self.NewClient(idIncr, pc, reg.Meta)
 			go client.Run(clientDidClose)
 
+			if replacing {
+				old := clients[oldId]
+				delete(clients, oldId)
+				delete(conns, oldId)
+				self.ReplaceClient(old, client)
+			} else {
+				self.AddClient(client)
+			}
 			clients[idIncr] = client
-			self.AddClient(client)
+			conns[idIncr] = pc
+			addrs[reg.Address] = idIncr
 
 		case id := <-clientDidClose:
-			self.RemoveClient(clients[id])
-			delete(clients, id)
+			if client, ok := clients[id]; ok {
+				self.RemoveClient(client)
+				delete(clients, id)
+				delete(conns, id)
+				for addr, addrId := range addrs {
+					if addrId == id {
+						delete(addrs, addr)
+					}
+				}
+			}
 
 		case <-self.sigShutdown:
 			info.Printf("[pair-server] Shutting down registration")
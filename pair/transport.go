@@ -0,0 +1,51 @@
+// Registration and pair connections are carried by a Transport. ZeroMQ is the default; the framed transport is a pure Go alternative speaking length-prefixed multipart frames over TCP or unix sockets.
+//
+// Addresses prefixed with `framed+` (e.g. `framed+tcp://127.0.0.1:5867` or `framed+unix:///tmp/stagger.sock`) always use the framed transport. Other addresses use the server's default transport, and client pair addresses use the transport over which the client registered.
+
+package pair
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// A Socket carries multipart messages
+type Socket interface {
+	// Recv returns the next message. It returns an error after the timeout
+	// the socket was created with, after which Recv may be called again
+	Recv() ([][]byte, error)
+	// Send sends a message without blocking. An error means that the peer is
+	// not currently able to receive
+	Send(parts ...[]byte) error
+	Close() error
+}
+
+type Transport interface {
+	// Listen binds a socket on which registrations are received
+	Listen(addr string, timeout time.Duration) (Socket, error)
+	// Dial connects a pair socket to a registered client
+	Dial(addr string, timeout time.Duration) (Socket, error)
+}
+
+const framedPrefix = "framed+"
+
+// TransportByName returns the transport for a -transport flag value
+func TransportByName(name string) (Transport, error) {
+	switch name {
+	case "zmq":
+		return ZmqTransport{}, nil
+	case "framed":
+		return FramedTransport{}, nil
+	}
+	return nil, fmt.Errorf("unknown transport %q (expected zmq or framed)", name)
+}
+
+// resolveAddress returns the transport for an address, and the address as
+// understood by that transport
+func resolveAddress(addr string, def Transport) (Transport, string) {
+	if strings.HasPrefix(addr, framedPrefix) {
+		return FramedTransport{}, strings.TrimPrefix(addr, framedPrefix)
+	}
+	return def, addr
+}
@@ -0,0 +1,75 @@
+package pair
+
+import (
+	zmq "github.com/pebbe/zmq4"
+	"time"
+)
+
+type ZmqTransport struct{}
+
+type zmqSocket struct {
+	*zmq.Socket
+}
+
+func (ZmqTransport) Listen(addr string, timeout time.Duration) (Socket, error) {
+	pull, err := zmq.NewSocket(zmq.PULL)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := pull.SetRcvtimeo(timeout); err != nil {
+		pull.Close()
+		return nil, err
+	}
+
+	if err := pull.Bind(addr); err != nil {
+		pull.Close()
+		return nil, err
+	}
+	return zmqSocket{pull}, nil
+}
+
+func (ZmqTransport) Dial(addr string, timeout time.Duration) (Socket, error) {
+	pair, err := zmq.NewSocket(zmq.PAIR)
+	if err != nil {
+		return nil, err
+	}
+
+	// Set a HWM to force an error when sending, thereby detecting that the
+	// client has gone away
+	if err := pair.SetSndhwm(1); err != nil {
+		pair.Close()
+		return nil, err
+	}
+
+	if err := pair.SetRcvtimeo(timeout); err != nil {
+		pair.Close()
+		return nil, err
+	}
+
+	if err := pair.Connect(addr); err != nil {
+		pair.Close()
+		return nil, err
+	}
+	return zmqSocket{pair}, nil
+}
+
+func (s zmqSocket) Recv() ([][]byte, error) {
+	return s.RecvMessageBytes(0)
+}
+
+func (s zmqSocket) Send(parts ...[]byte) (err error) {
+	// Note: I considered using the cleaner SendMessage but unfortunately that
+	// doesn't currently support arbitrary flags
+	// Using DONTWAIT to avoid Send blocking when HWM is reached
+	for i, part := range parts {
+		flags := zmq.DONTWAIT
+		if i < len(parts)-1 {
+			flags |= zmq.SNDMORE
+		}
+		if _, err = s.SendBytes(part, flags); err != nil {
+			return
+		}
+	}
+	return
+}
@@ -0,0 +1,276 @@
+// Exposes aggregated stats in the Prometheus text exposition format, so that a Prometheus server can scrape stagger directly.
+//
+// Prometheus expects counters to be cumulative, so counters, Dist weights and sums, and histogram buckets are accumulated across intervals since startup. Counters are exported as `_total` counters, Dists as summaries (`_count` and `_sum`) with the min and max of the last interval as `_min` and `_max` gauges, and histograms as Prometheus histograms. Stat types become unit suffixes (e.g. `ms` becomes `_milliseconds`), and segments of segmented stats become labels.
+//
+// Only the full combinations of a segmented stat are exported. Its total and per-dimension roll-ups are skipped, since they would be counted again by queries summing over the labels (e.g. `sum(conns_total)`).
+//
+// Clients report histograms as bucket counts only, so the `_sum` of a histogram is estimated from the middle of each bucket (the outermost bound for the first and last buckets). A histogram's bounds are fixed when it is first seen, since cumulative `_bucket` series can't change bounds. Buckets reported later with other bounds are counted in the first fixed bucket whose bound is no lower.
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+)
+
+var prometheusUnits = map[string]string{
+	"ms":    "milliseconds",
+	"s":     "seconds",
+	"bytes": "bytes",
+}
+
+var prometheusInvalidName = regexp.MustCompile(`[^a-zA-Z0-9_]`)
+
+// Label values may contain any UTF-8, but backslashes, quotes and newlines
+// must be escaped
+var prometheusLabelEscaper = strings.NewReplacer("\\", `\\`, "\"", `\"`, "\n", `\n`)
+
+type Prometheus struct {
+	mutex      sync.Mutex
+	counters   CounterMap
+	dists      DistMap // cumulative
+	lastDists  DistMap // last interval, for min & max
+	histograms HistogramMap
+	types      TypeMap
+	segments   SegmentMap
+}
+
+func NewPrometheus() *Prometheus {
+	return &Prometheus{
+		counters:   CounterMap{},
+		dists:      DistMap{},
+		lastDists:  DistMap{},
+		histograms: HistogramMap{},
+		types:      TypeMap{},
+		segments:   SegmentMap{},
+	}
+}
+
+func (p *Prometheus) Send(stats *TimestampedStats) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	for key, value := range stats.Counters {
+		p.counters[key] += value
+	}
+	for key, value := range stats.Dists {
+		copied := *value
+		if d, ok := p.dists[key]; ok {
+			d.Add(&copied)
+		} else {
+			p.dists[key] = &copied
+		}
+		p.lastDists[key] = value
+	}
+	for key, value := range stats.Histograms {
+		if h, ok := p.histograms[key]; ok {
+			for i, c := range rebucket(value, h.Bounds) {
+				h.Counts[i] += c
+			}
+		} else {
+			copied, _ := NewHistogram(value.Bounds, value.Counts)
+			p.histograms[key] = copied
+		}
+	}
+	for key, value := range stats.Types {
+		p.types[key] = value
+	}
+	for key, value := range stats.Segments {
+		p.segments[key] = value
+	}
+}
+
+// segmentLabels matches name against the known segmented stats, returning
+// the stat's name and its segments as labels. ok is false for the total and
+// roll-ups of a segmented stat, which aren't exported
+func (p *Prometheus) segmentLabels(name string) (base, labels string, ok bool) {
+	var dims []string
+	for b, d := range p.segments {
+		if (name == b || strings.HasPrefix(name, b+".")) && len(b) > len(base) {
+			base, dims = b, d
+		}
+	}
+	if base == "" {
+		return name, "", true
+	}
+
+	// Expect a key for every dimension in order, e.g. .type:HTTP.user:42.
+	// Keys may contain dots, so each runs up to the next dimension
+	rest := name[len(base):]
+	pairs := make([]string, len(dims))
+	for i, dim := range dims {
+		prefix := "." + dim + ":"
+		if !strings.HasPrefix(rest, prefix) {
+			return "", "", false
+		}
+		rest = rest[len(prefix):]
+		end := len(rest)
+		if i+1 < len(dims) {
+			if end = strings.Index(rest, "."+dims[i+1]+":"); end < 0 {
+				return "", "", false
+			}
+		}
+		pairs[i] = fmt.Sprintf("%v=\"%v\"", prometheusName(dim), prometheusLabelValue(rest[:end]))
+		rest = rest[end:]
+	}
+	return base, strings.Join(pairs, ","), true
+}
+
+// metricName returns the Prometheus metric name and labels for a stat,
+// splitting segments (e.g. connections.type:HTTP) out as labels. ok is false
+// for stats which shouldn't be exported
+func (p *Prometheus) metricName(name string) (metric, labels string, ok bool) {
+	base, labels, ok := p.segmentLabels(name)
+	if !ok {
+		return "", "", false
+	}
+
+	metric = prometheusName(base)
+	if t, ok := p.types[name]; ok && t != nil {
+		if unit, ok := prometheusUnits[*t]; ok {
+			metric += "_" + unit
+		}
+	}
+	return metric, labels, true
+}
+
+// rebucket returns the counts of h in buckets with the given bounds, counting
+// each of its buckets in the first one whose bound is no lower than its own
+func rebucket(h *Histogram, bounds []float64) []float64 {
+	counts := make([]float64, len(bounds)+1)
+	for i, c := range h.Counts {
+		upper := math.Inf(1)
+		if i < len(h.Bounds) {
+			upper = h.Bounds[i]
+		}
+		counts[sort.SearchFloat64s(bounds, upper)] += c
+	}
+	return counts
+}
+
+// histogramSum estimates the sum of the values in a histogram from the middle
+// of each bucket
+func histogramSum(h *Histogram) float64 {
+	if len(h.Bounds) == 0 {
+		return 0
+	}
+	var sum float64
+	for i, count := range h.Counts {
+		if count == 0 {
+			continue
+		}
+		switch {
+		case i == 0:
+			sum += count * h.Bounds[0]
+		case i == len(h.Bounds):
+			sum += count * h.Bounds[i-1]
+		default:
+			sum += count * (h.Bounds[i-1] + h.Bounds[i]) / 2
+		}
+	}
+	return sum
+}
+
+func prometheusName(name string) string {
+	n := prometheusInvalidName.ReplaceAllString(name, "_")
+	if n == "" || (n[0] >= '0' && n[0] <= '9') {
+		n = "_" + n
+	}
+	return n
+}
+
+func prometheusLabelValue(value string) string {
+	return prometheusLabelEscaper.Replace(value)
+}
+
+func withLabels(labels string, extra ...string) string {
+	all := extra
+	if labels != "" {
+		all = append([]string{labels}, extra...)
+	}
+	if len(all) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(all, ",") + "}"
+}
+
+// A metric family, with its TYPE and samples
+type prometheusFamily struct {
+	kind    string
+	samples []string
+}
+
+func (p *Prometheus) render() []byte {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	families := map[string]*prometheusFamily{}
+	add := func(name, kind, sample string) {
+		f, ok := families[name]
+		if !ok {
+			f = &prometheusFamily{kind: kind}
+			families[name] = f
+		}
+		f.samples = append(f.samples, sample)
+	}
+
+	for key, value := range p.counters {
+		metric, labels, ok := p.metricName(key)
+		if !ok {
+			continue
+		}
+		add(metric+"_total", "counter", fmt.Sprintf("%v_total%v %v", metric, withLabels(labels), value))
+	}
+	for key, value := range p.dists {
+		metric, labels, ok := p.metricName(key)
+		if !ok {
+			continue
+		}
+		add(metric, "summary", fmt.Sprintf("%v_count%v %v", metric, withLabels(labels), value.N))
+		add(metric, "summary", fmt.Sprintf("%v_sum%v %v", metric, withLabels(labels), value.Sum_x))
+		last := p.lastDists[key]
+		add(metric+"_min", "gauge", fmt.Sprintf("%v_min%v %v", metric, withLabels(labels), last.Min))
+		add(metric+"_max", "gauge", fmt.Sprintf("%v_max%v %v", metric, withLabels(labels), last.Max))
+	}
+	for key, value := range p.histograms {
+		metric, labels, ok := p.metricName(key)
+		if !ok {
+			continue
+		}
+		var cumulative float64
+		for i, b := range value.Bounds {
+			cumulative += value.Counts[i]
+			add(metric, "histogram", fmt.Sprintf("%v_bucket%v %v", metric, withLabels(labels, fmt.Sprintf("le=\"%v\"", b)), cumulative))
+		}
+		add(metric, "histogram", fmt.Sprintf("%v_bucket%v %v", metric, withLabels(labels, `le="+Inf"`), value.N()))
+		add(metric, "histogram", fmt.Sprintf("%v_count%v %v", metric, withLabels(labels), value.N()))
+		add(metric, "histogram", fmt.Sprintf("%v_sum%v %v", metric, withLabels(labels), histogramSum(value)))
+	}
+
+	names := make([]string, 0, len(families))
+	for name := range families {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var b bytes.Buffer
+	for _, name := range names {
+		f := families[name]
+		sort.Strings(f.samples)
+		fmt.Fprintf(&b, "# TYPE %v %v\n", name, f.kind)
+		for _, s := range f.samples {
+			fmt.Fprintln(&b, s)
+		}
+	}
+	return b.Bytes()
+}
+
+func (p *Prometheus) ServeHTTP(w http.ResponseWriter, h *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	w.Write(p.render())
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func Test_PrometheusExposition(t *testing.T) {
+	p := NewPrometheus()
+	ms := "ms"
+	for i := 0; i < 2; i++ {
+		stats := NewTimestampedStats(int64(i))
+		stats.AddCount(StatCount{"requests", 3, nil})
+		stats.AddValue(StatValue{Name: "latency", Value: float64(10 * (i + 1)), Type: &ms})
+		stats.AddSegmentedCount(StatSegmented{
+			Name:       "conns",
+			Dimensions: []string{"type"},
+			Segments:   []Segment{{[]string{"HTTP"}, 2}},
+		})
+		p.Send(stats)
+	}
+	out := string(p.render())
+
+	for _, line := range []string{
+		"# TYPE requests_total counter",
+		"requests_total 6",
+		"# TYPE latency_milliseconds summary",
+		"latency_milliseconds_count 2",
+		"latency_milliseconds_sum 30",
+		"latency_milliseconds_min 20",
+		"latency_milliseconds_max 20",
+		`conns_total{type="HTTP"} 4`,
+	} {
+		if !strings.Contains(out, line+"\n") {
+			t.Errorf("missing %q in:\n%v", line, out)
+		}
+	}
+	if strings.Contains(out, "conns_total 4") {
+		t.Errorf("expected segment total to be skipped:\n%v", out)
+	}
+}
+
+func Test_PrometheusSegmentsAndHistograms(t *testing.T) {
+	p := NewPrometheus()
+	stats := NewTimestampedStats(1)
+	stats.AddSegmentedCount(StatSegmented{
+		Name:       "http.requests",
+		Dimensions: []string{"host", "code"},
+		Segments:   []Segment{{[]string{"web1.dc1", "200"}, 3}, {[]string{"web2.dc1", "500"}, 1}},
+	})
+	stats.AddHistogram(StatHistogram{"size", []float64{10, 20}, []float64{1, 2, 1}, nil})
+	p.Send(stats)
+	out := string(p.render())
+
+	for _, line := range []string{
+		`http_requests_total{host="web1.dc1",code="200"} 3`,
+		`http_requests_total{host="web2.dc1",code="500"} 1`,
+		`size_count 4`,
+		`size_sum 60`,
+	} {
+		if !strings.Contains(out, line+"\n") {
+			t.Errorf("missing %q in:\n%v", line, out)
+		}
+	}
+	if n := strings.Count(out, "http_requests_total"); n != 3 {
+		t.Errorf("expected only the full combinations (and TYPE), got:\n%v", out)
+	}
+}
+
+func Test_PrometheusLabelValue(t *testing.T) {
+	for value, expected := range map[string]string{
+		"HTTP":        "HTTP",
+		"café/日本":     "café/日本",
+		`a"b\c`:       `a\"b\\c`,
+		"line\nbreak": `line\nbreak`,
+		"bell\a\ttab": "bell\a\ttab",
+	} {
+		if escaped := prometheusLabelValue(value); escaped != expected {
+			t.Errorf("expected %q to be escaped as %q, got %q", value, expected, escaped)
+		}
+	}
+
+	p := NewPrometheus()
+	stats := NewTimestampedStats(1)
+	stats.AddSegmentedCount(StatSegmented{
+		Name:       "conns",
+		Dimensions: []string{"city"},
+		Segments:   []Segment{{[]string{"Zürich"}, 1}},
+	})
+	p.Send(stats)
+	if out := string(p.render()); !strings.Contains(out, `conns_total{city="Zürich"} 1`+"\n") {
+		t.Errorf("expected a raw UTF-8 label value in:\n%v", out)
+	}
+}
+
+func Test_PrometheusHistogramBoundsArePinned(t *testing.T) {
+	p := NewPrometheus()
+	for _, h := range []StatHistogram{
+		{"size", []float64{10, 20}, []float64{1, 2, 1}, nil},
+		{"size", []float64{5, 15, 30}, []float64{1, 1, 1, 1}, nil},
+	} {
+		stats := NewTimestampedStats(1)
+		stats.AddHistogram(h)
+		p.Send(stats)
+	}
+	out := string(p.render())
+
+	for _, line := range []string{
+		`size_bucket{le="10"} 2`,
+		`size_bucket{le="20"} 5`,
+		`size_bucket{le="+Inf"} 8`,
+		`size_count 8`,
+	} {
+		if !strings.Contains(out, line+"\n") {
+			t.Errorf("missing %q in:\n%v", line, out)
+		}
+	}
+	if strings.Contains(out, `le="5"`) || strings.Contains(out, `le="30"`) {
+		t.Errorf("expected the first bounds to be kept:\n%v", out)
+	}
+}
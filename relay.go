@@ -0,0 +1,230 @@
+// Relay subscribes to the ZMQ PUB output (see ZmqPub) of one or more upstream stagger processes, and re-aggregates their output as if each were a client. Counters are summed and Dists and histograms added together for each timestamp, giving e.g. datacenter wide totals, which are then output like locally aggregated stats (including to this process's own PUB socket, so relays can be chained).
+//
+// A timestamp is complete once every upstream has published its end of interval message for it, or after a timeout. An upstream which can't be subscribed to, or whose socket fails, is no longer waited for. Nor is one which hasn't reported any of the last few timestamps (e.g. because it is down, which a SUB socket can't detect) until it reports again, so that one outage doesn't delay every timestamp by the timeout. On shutdown every pending timestamp is output, however many upstreams have reported it.
+
+package main
+
+import (
+	zmq "github.com/pebbe/zmq4"
+	"sort"
+	"syscall"
+	"time"
+)
+
+// Upstreams which haven't reported any of this many of the last emitted
+// timestamps aren't waited for
+const relayRecentTimestamps = 3
+
+// A stat received from an upstream
+type relayStat struct {
+	upstream int
+	name     string
+	envelope PubEnvelope
+}
+
+type Relay struct {
+	upstreams   []string
+	timeout     time.Duration
+	stats       chan relayStat
+	gone        chan int
+	output      chan (*TimestampedStats)
+	sigShutdown chan bool
+}
+
+func NewRelay(upstreams []string, timeout time.Duration) *Relay {
+	return &Relay{
+		upstreams:   upstreams,
+		timeout:     timeout,
+		stats:       make(chan relayStat),
+		gone:        make(chan int),
+		output:      make(chan *TimestampedStats),
+		sigShutdown: make(chan bool),
+	}
+}
+
+// subscribe receives stats from an upstream, notifying Run if it gives up
+func (r *Relay) subscribe(upstream int) {
+	addr := r.upstreams[upstream]
+	defer func() { r.gone <- upstream }()
+
+	sub, err := zmq.NewSocket(zmq.SUB)
+	if err != nil {
+		info.Printf("[relay] Error creating socket for %v: %v", addr, err)
+		return
+	}
+	defer sub.Close()
+	if err := sub.Connect(addr); err != nil {
+		info.Printf("[relay] Error connecting to %v: %v", addr, err)
+		return
+	}
+	sub.SetSubscribe("")
+	info.Printf("[relay] Subscribed to %v", addr)
+
+	for {
+		parts, err := sub.RecvMessageBytes(0)
+		if err != nil {
+			if errno := zmq.AsErrno(err); errno == zmq.Errno(syscall.EAGAIN) || errno == zmq.Errno(syscall.EINTR) {
+				continue
+			}
+			// e.g. ETERM when the context is terminated
+			info.Printf("[relay] Error receiving from %v, unsubscribing: %v", addr, err)
+			return
+		}
+		if len(parts) != 2 {
+			info.Printf("[relay] Unexpected message from %v with %v parts", addr, len(parts))
+			continue
+		}
+		var e PubEnvelope
+		if err := unmarshal(parts[1], &e); err != nil {
+			info.Printf("[relay] Error decoding %s from %v: %v", parts[0], addr, err)
+			continue
+		}
+		r.stats <- relayStat{upstream, string(parts[0]), e}
+	}
+}
+
+func (r *Relay) Run() {
+	for i := range r.upstreams {
+		go r.subscribe(i)
+	}
+
+	// Upstreams still subscribed to
+	live := map[int]bool{}
+	for i := range r.upstreams {
+		live[i] = true
+	}
+
+	pending := map[int64]*TimestampedStats{}
+	// Upstreams which have finished reporting each pending timestamp
+	sources := map[int64]map[int]bool{}
+	// When each pending timestamp was first seen, for timeouts
+	firstSeen := map[int64]time.Time{}
+	var lastEmitted int64
+	// The last timestamp each upstream reported, and the most recently
+	// emitted timestamps (oldest first)
+	lastReported := map[int]int64{}
+	recent := []int64{}
+
+	emit := func(ts int64) {
+		stats := pending[ts]
+		stats.AddCount(StatCount{"stagger.relay.sources", float64(len(sources[ts])), nil})
+		debug.Printf("[relay] (ts:%v) Finished aggregating data from %v upstreams", ts, len(sources[ts]))
+		delete(pending, ts)
+		delete(sources, ts)
+		delete(firstSeen, ts)
+		lastEmitted = ts
+		if recent = append(recent, ts); len(recent) > relayRecentTimestamps {
+			recent = recent[1:]
+		}
+		r.output <- stats
+	}
+
+	// Emits, in order, the pending timestamps for which fn returns true
+	emitWhere := func(fn func(ts int64) bool) {
+		timestamps := make([]int64, 0, len(pending))
+		for ts := range pending {
+			timestamps = append(timestamps, ts)
+		}
+		sort.Sort(int64s(timestamps))
+		for _, ts := range timestamps {
+			if !fn(ts) {
+				return
+			}
+			emit(ts)
+		}
+	}
+
+	// Whether an upstream is expected to report, i.e. it is live and (once
+	// enough timestamps have been emitted to tell) reported a recent one
+	expected := func(i int) bool {
+		if !live[i] {
+			return false
+		}
+		return len(recent) < relayRecentTimestamps || lastReported[i] >= recent[0]
+	}
+
+	// Whether every expected upstream has reported a timestamp
+	reported := func(ts int64) bool {
+		for i := range r.upstreams {
+			if expected(i) && !sources[ts][i] {
+				return false
+			}
+		}
+		return true
+	}
+
+	check := time.NewTicker(time.Second)
+	defer check.Stop()
+
+	for {
+		select {
+		case s := <-r.stats:
+			e := s.envelope
+			ts := e.Timestamp
+			if ts <= lastEmitted {
+				info.Printf("[relay] (ts:%v) Stats received from %v after timestamp completed, discarding", ts, r.upstreams[s.upstream])
+				continue
+			}
+			if _, ok := pending[ts]; !ok {
+				pending[ts] = NewTimestampedStats(ts)
+				sources[ts] = map[int]bool{}
+				firstSeen[ts] = time.Now()
+			}
+
+			switch e.Kind {
+			case "counter":
+				pending[ts].AddCount(StatCount{s.name, e.Count, e.Type})
+			case "dist":
+				if e.Dist != nil {
+					pending[ts].AddDist(StatDist{s.name, [5]float64{e.Dist.N, e.Dist.Min, e.Dist.Max, e.Dist.Sum_x, e.Dist.Sum_x2}, e.Type})
+				}
+			case "histogram":
+				if e.Histogram != nil {
+					pending[ts].AddHistogram(StatHistogram{s.name, e.Histogram.Bounds, e.Histogram.Counts, e.Type})
+				}
+			case "end":
+				sources[ts][s.upstream] = true
+				if ts > lastReported[s.upstream] {
+					lastReported[s.upstream] = ts
+				}
+				emitWhere(reported)
+			default:
+				info.Printf("[relay] Unknown kind %v from %v", e.Kind, r.upstreams[s.upstream])
+			}
+
+		case i := <-r.gone:
+			delete(live, i)
+			info.Printf("[relay] No longer waiting for %v (%v of %v upstreams subscribed)", r.upstreams[i], len(live), len(r.upstreams))
+			emitWhere(reported)
+
+		case now := <-check.C:
+			emitWhere(func(ts int64) bool {
+				if now.Sub(firstSeen[ts]) < r.timeout {
+					return false
+				}
+				info.Printf("[relay] (ts:%v) Timed out, %v of %v upstreams reported", ts, len(sources[ts]), len(r.upstreams))
+				return true
+			})
+
+		case <-r.sigShutdown:
+			emitWhere(func(ts int64) bool {
+				info.Printf("[relay] (ts:%v) Shutting down, %v of %v upstreams reported", ts, len(sources[ts]), len(r.upstreams))
+				return true
+			})
+			close(r.output)
+			return
+		}
+	}
+}
+
+// Shutdown stops the relay, which closes the output channel once every
+// pending timestamp has been output
+func (r *Relay) Shutdown() {
+	r.sigShutdown <- true
+}
+
+type int64s []int64
+
+func (a int64s) Len() int           { return len(a) }
+func (a int64s) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+func (a int64s) Less(i, j int) bool { return a[i] < a[j] }
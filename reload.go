@@ -0,0 +1,326 @@
+// Reloader builds the outputters and HTTP features from the config, and is given the reloaded config on SIGHUP. Changes to the survey settings are passed on to the ClientManager, but neither the pair server nor the aggregator are touched, so connected clients are unaffected by a reload.
+//
+// Each outputter is only rebuilt if its section of the config changed; the old one is stopped (outputting anything it has queued) before the new one is started, since they may share a file or address. An unchanged librato outputter therefore keeps its queue, and websocket connections stay open unless ws_backlog changed.
+//
+// Handlers can't be removed from an http.ServeMux, so the HTTP features are served from a new mux built on each reload, which the Reloader swaps in. Outputters behind features which changed are only stopped once the new mux is in place, so that no request is handled by a stopped one.
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+type Reloader struct {
+	output   *Output
+	cm       *ClientManager  // nil in relay mode
+	push     chan<- (*Stats) // nil in relay mode
+	http_on  bool            // whether an HTTP(S) server is running
+	ssl_ca   bool
+	applied  *Config
+	features map[string]bool
+
+	history         *History
+	snapshot        *Snapshot
+	websocketsender *Websocketsender
+	prometheus      *Prometheus
+
+	mux_mutex sync.RWMutex
+	mux       *http.ServeMux
+}
+
+// NewReloader creates a Reloader for the outputters registered with output.
+// The ClientManager (if any) must have been started with the survey settings
+// of c, so that they are only reconfigured once they change
+func NewReloader(output *Output, cm *ClientManager, c *Config, push chan<- (*Stats), http_on, ssl_ca bool) *Reloader {
+	return &Reloader{
+		output:   output,
+		cm:       cm,
+		push:     push,
+		http_on:  http_on,
+		ssl_ca:   ssl_ca,
+		applied:  &Config{Interval: c.Interval, Timeout: c.Timeout, Survey: c.Survey},
+		features: map[string]bool{},
+		mux:      http.NewServeMux(),
+	}
+}
+
+// replace stops and removes the outputter registered under name, and
+// registers op (if not nil) in its place
+func (r *Reloader) replace(name string, op Outputter) {
+	r.stop(name, r.output.Remove(name))
+	r.add(name, op)
+}
+
+// swap registers op (if not nil) in place of the outputter registered under
+// name, returning the old one without stopping it
+func (r *Reloader) swap(name string, op Outputter) Outputter {
+	old := r.output.Remove(name)
+	r.add(name, op)
+	return old
+}
+
+func (r *Reloader) add(name string, op Outputter) {
+	if op != nil {
+		r.output.Add(name, op)
+		info.Printf("[reload] Started %v", name)
+	}
+}
+
+func (r *Reloader) stop(name string, op Outputter) {
+	if op != nil {
+		if s, ok := op.(Stopper); ok {
+			s.Stop()
+		}
+		info.Printf("[reload] Stopped %v", name)
+	}
+}
+
+// Apply brings the outputters and HTTP features in line with c. Outputters
+// which fail to start are logged, left disabled and returned as an error;
+// they are retried on the next Apply
+func (r *Reloader) Apply(c *Config) error {
+	old := r.applied
+	applied := *c
+	errs := []string{}
+	failed := func(name string, err error) {
+		errs = append(errs, fmt.Sprintf("%v: %v", name, err))
+		info.Printf("[reload] Error starting %v: %v", name, err)
+	}
+
+	if r.cm != nil && (c.Interval != old.Interval || c.Survey != old.Survey || c.Timeout != old.Timeout) {
+		schedule, err := ParseSurveySchedule(c.Survey)
+		if err == nil && c.Interval < 1 {
+			err = fmt.Errorf("invalid interval %v", c.Interval)
+		}
+		if err != nil {
+			failed("survey", err)
+			applied.Interval, applied.Survey, applied.Timeout = old.Interval, old.Survey, old.Timeout
+		} else {
+			r.cm.Reconfigure(schedule, c.Interval, c.Timeout)
+		}
+	}
+
+	if c.Librato != old.Librato || c.SourceFor(c.Librato.Source) != old.SourceFor(old.Librato.Source) {
+		var op Outputter
+		if c.Librato.Email != "" && c.Librato.Token != "" {
+			librato := NewLibrato(c.SourceFor(c.Librato.Source), c.Librato.Email, c.Librato.Token)
+			go librato.Run()
+			op = librato
+		}
+		r.replace("librato", op)
+	}
+
+	if c.Graphite != old.Graphite || c.SourceFor(c.Graphite.Source) != old.SourceFor(old.Graphite.Source) {
+		var op Outputter
+		if c.Graphite.Addr != "" {
+			graphite := NewGraphite(c.Graphite.Addr, c.Graphite.Prefix, c.SourceFor(c.Graphite.Source))
+			go graphite.Run()
+			op = graphite
+		}
+		r.replace("graphite", op)
+	}
+
+	if c.InfluxDB != old.InfluxDB || c.SourceFor(c.InfluxDB.Source) != old.SourceFor(old.InfluxDB.Source) {
+		r.replace("influxdb", nil)
+		if c.InfluxDB.URL != "" {
+			if influxdb, err := NewInfluxDB(c.InfluxDB.URL, c.SourceFor(c.InfluxDB.Source)); err != nil {
+				failed("influxdb", err)
+				applied.InfluxDB = InfluxDBConfig{}
+			} else {
+				go influxdb.Run()
+				r.replace("influxdb", influxdb)
+			}
+		}
+	}
+
+	if c.File != old.File {
+		var op Outputter
+		if c.File.Path != "" {
+			file_output := NewFileOutput(c.File.Path, c.File.MaxSize<<20, c.File.MaxAge, c.File.Gzip, c.File.Keep)
+			go file_output.Run()
+			op = file_output
+		}
+		r.replace("file", op)
+	}
+
+	if c.History != old.History {
+		r.replace("history", nil)
+		r.history = nil
+		if c.History.Dir != "" {
+			retention := [4]time.Duration{c.History.Raw, c.History.OneM, c.History.OneH, c.History.OneD}
+			if history, err := NewHistory(c.History.Dir, retention); err != nil {
+				failed("history", err)
+				applied.History = HistoryConfig{}
+			} else {
+				go history.Run()
+				r.history = history
+				r.replace("history", history)
+			}
+		}
+	}
+
+	if c.Pub != old.Pub {
+		r.replace("pub", nil)
+		if c.Pub.Addr != "" {
+			if zmq_pub, err := NewZmqPub(c.Pub.Addr); err != nil {
+				failed("pub", fmt.Errorf("binding zmq pub to %v: %v", c.Pub.Addr, err))
+				applied.Pub = PubConfig{}
+			} else {
+				r.replace("pub", zmq_pub)
+			}
+		}
+	}
+
+	if c.LogOutput != old.LogOutput {
+		var op Outputter
+		if c.LogOutput {
+			op = NewStdOut()
+		}
+		r.replace("log", op)
+	}
+
+	r.applyFeatures(c, old)
+	r.applied = &applied
+
+	if len(errs) > 0 {
+		return fmt.Errorf("%v", strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// applyFeatures starts or stops the outputters behind HTTP features, and
+// swaps in a new mux serving the enabled features
+func (r *Reloader) applyFeatures(c, old_c *Config) {
+	features := map[string]bool{}
+	if r.http_on {
+		features = c.HTTPFeatures()
+	}
+	old := r.features
+	r.features = features
+
+	// Replaced outputters, stopped once the new mux is in place
+	stale := map[string]Outputter{}
+
+	if features["http-json"] != old["http-json"] {
+		r.snapshot = nil
+		if features["http-json"] {
+			r.snapshot = NewSnapshot()
+			stale["http-json"] = r.swap("http-json", r.snapshot)
+		} else {
+			stale["http-json"] = r.swap("http-json", nil)
+		}
+	}
+
+	if features["ws-json"] != old["ws-json"] || c.HTTP.WSBacklog != old_c.HTTP.WSBacklog {
+		r.websocketsender = nil
+		if features["ws-json"] {
+			r.websocketsender = NewWebsocketsender(c.HTTP.WSBacklog)
+			stale["ws-json"] = r.swap("ws-json", r.websocketsender)
+		} else {
+			stale["ws-json"] = r.swap("ws-json", nil)
+		}
+	}
+
+	if features["prometheus"] != old["prometheus"] {
+		r.prometheus = nil
+		if features["prometheus"] {
+			r.prometheus = NewPrometheus()
+			stale["prometheus"] = r.swap("prometheus", r.prometheus)
+		} else {
+			stale["prometheus"] = r.swap("prometheus", nil)
+		}
+	}
+
+	mux := http.NewServeMux()
+	// pprof registers itself with the default mux
+	mux.Handle("/debug/", http.DefaultServeMux)
+
+	if r.snapshot != nil {
+		mux.Handle("/snapshot.json", r.snapshot)
+	}
+	if r.websocketsender != nil {
+		mux.Handle("/ws.json", r.websocketsender.GetWebsocketSenderHandler())
+	}
+	if features["history-json"] && r.history != nil {
+		mux.Handle("/history.json", NewHistoryJSON(r.history))
+	}
+	if r.prometheus != nil {
+		mux.Handle("/metrics", r.prometheus)
+	}
+	if features["ingest"] && r.push != nil {
+		mux.Handle("/ingest", NewIngest(r.push, r.ssl_ca))
+	}
+	if features["sparkline"] {
+		handleSparkline(mux)
+	}
+
+	for _, f := range []string{"http-json", "ws-json", "history-json", "prometheus", "ingest", "sparkline"} {
+		switch {
+		case features[f] && !old[f]:
+			info.Printf("[reload] HTTP feature %v enabled", f)
+		case !features[f] && old[f]:
+			info.Printf("[reload] HTTP feature %v disabled", f)
+		}
+	}
+	if features["ingest"] && !old["ingest"] {
+		if r.push == nil {
+			info.Print("[reload] WARNING: JSON ingest is not available in relay mode")
+		} else if !r.ssl_ca {
+			info.Print("[reload] WARNING: No client certificate CA specified, ingest is unauthenticated")
+		}
+	}
+
+	r.mux_mutex.Lock()
+	r.mux = mux
+	r.mux_mutex.Unlock()
+
+	for name, op := range stale {
+		r.stop(name, op)
+	}
+}
+
+func handleSparkline(mux *http.ServeMux) {
+	js_data := []string{"/jquery.js",
+		"/jquery.sparkline.js",
+		"/jquery.appear.js",
+		"/jquery.jqplot.js",
+		"/jquery.jqplot.css",
+		"/reconnecting-websocket.js"}
+
+	for _, n := range js_data {
+		n := n
+		js, _ := Asset("sparkline" + n)
+		mux.HandleFunc(n,
+			func(w http.ResponseWriter, req *http.Request) {
+				w.Header().Set("Content-Type", "application/javascript")
+				http.ServeContent(w, req, n, time.Time{}, bytes.NewReader(js))
+			})
+	}
+	hb, _ := Asset("sparkline/spark.html")
+	mux.HandleFunc("/spark",
+		func(w http.ResponseWriter, req *http.Request) {
+			w.Header().Set("Content-Type", "text/html")
+			http.ServeContent(w, req, "spark", time.Time{}, bytes.NewReader(hb))
+		})
+	mux.HandleFunc("/",
+		func(w http.ResponseWriter, req *http.Request) {
+			if req.URL.Path != "/" {
+				http.NotFound(w, req)
+				return
+			}
+			http.Redirect(w, req, "/spark", http.StatusFound)
+		})
+}
+
+// ServeHTTP serves the HTTP features enabled by the last Apply
+func (r *Reloader) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	r.mux_mutex.RLock()
+	mux := r.mux
+	r.mux_mutex.RUnlock()
+	mux.ServeHTTP(w, req)
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func Test_ReloaderReplacesChangedOutputters(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "stagger")
+	defer os.RemoveAll(dir)
+
+	output := NewOutput()
+	r := NewReloader(output, nil, &Config{}, nil, false, false)
+	c := &Config{File: FileConfig{Path: filepath.Join(dir, "a.json")}, LogOutput: true}
+	if err := r.Apply(c); err != nil {
+		t.Fatal(err)
+	}
+	if len(output.outputs) != 2 {
+		t.Fatalf("expected file and log outputters, got %v", output.outputs)
+	}
+	first := output.outputs[0].op
+
+	// Unchanged sections are left alone
+	r.Apply(c)
+	if output.outputs[0].op != first {
+		t.Error("expected unchanged file outputter to be kept")
+	}
+
+	first.Send(NewTimestampedStats(1))
+	c2 := *c
+	c2.File.Path = filepath.Join(dir, "b.json")
+	c2.LogOutput = false
+	r.Apply(&c2)
+	if len(output.outputs) != 1 || output.outputs[0].op == first {
+		t.Fatalf("expected only a new file outputter, got %v", output.outputs)
+	}
+
+	// The old outputter was stopped, writing what it had queued first
+	if b, _ := ioutil.ReadFile(filepath.Join(dir, "a.json")); len(b) == 0 {
+		t.Error("expected queued stats to be written when stopped")
+	}
+}
+
+func Test_ReloaderOnlyReconfiguresChangedSurveySettings(t *testing.T) {
+	c := &Config{Interval: 10, Timeout: 1000, Survey: "1:conns"}
+	schedule, _ := ParseSurveySchedule(c.Survey)
+	cm := NewClientManager(NewAggregator(), schedule, c.Interval)
+	r := NewReloader(NewOutput(), cm, c, nil, false, false)
+
+	// The ClientManager isn't running, so reconfiguring it would block
+	applied := make(chan bool)
+	go func() {
+		r.Apply(c)
+		applied <- true
+	}()
+	select {
+	case <-applied:
+	case <-time.After(time.Second):
+		t.Fatal("expected the startup survey settings not to be reconfigured")
+	}
+
+	c2 := *c
+	c2.Timeout = 500
+	go r.Apply(&c2)
+	select {
+	case s := <-cm.reconfigure:
+		if s.timeout != 500 || s.interval != 10 {
+			t.Errorf("unexpected survey settings %+v", s)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("expected the changed timeout to be reconfigured")
+	}
+}
@@ -0,0 +1,40 @@
+// Segmented stats are expanded into plain stats so that they flow through aggregation and every output unchanged. A stat `connections` segmented by (type, user) reported as
+//
+//     ((HTTP, 42), 13), ((HTTP, 12), 11)
+//
+// expands to one stat per combination (`connections.type:HTTP.user:42`), one per value of each dimension summed over the others (`connections.type:HTTP`, `connections.user:42`), and the total (`connections`). Roll-ups are summed within a single report, and then aggregated across clients like any other value or count.
+
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+func segmentName(name string, dims []string, keys []string) string {
+	parts := []string{name}
+	for i, dim := range dims {
+		parts = append(parts, fmt.Sprintf("%v:%v", dim, keys[i]))
+	}
+	return strings.Join(parts, ".")
+}
+
+// Expand returns the value of every segment combination, per-dimension
+// roll-up, and total, keyed by the expanded stat name
+func (s StatSegmented) Expand() map[string]float64 {
+	expanded := map[string]float64{}
+	for _, seg := range s.Segments {
+		if len(seg.Keys) != len(s.Dimensions) {
+			info.Printf("[segments] %v: segment %v does not match dimensions %v, discarding", s.Name, seg.Keys, s.Dimensions)
+			continue
+		}
+		expanded[s.Name] += seg.Value
+		if len(s.Dimensions) > 1 {
+			expanded[segmentName(s.Name, s.Dimensions, seg.Keys)] += seg.Value
+		}
+		for i, dim := range s.Dimensions {
+			expanded[segmentName(s.Name, []string{dim}, seg.Keys[i:i+1])] += seg.Value
+		}
+	}
+	return expanded
+}
@@ -0,0 +1,46 @@
+package main
+
+import "testing"
+
+func Test_ExpandingSegments(t *testing.T) {
+	s := StatSegmented{
+		Name:       "connections",
+		Dimensions: []string{"type", "user"},
+		Segments: []Segment{
+			{[]string{"HTTP", "42"}, 13},
+			{[]string{"HTTP", "12"}, 11},
+			{[]string{"HTTPS", "42"}, 2},
+		},
+	}
+	e := s.Expand()
+
+	expected := map[string]float64{
+		"connections":                    26,
+		"connections.type:HTTP":          24,
+		"connections.type:HTTPS":         2,
+		"connections.user:42":            15,
+		"connections.user:12":            11,
+		"connections.type:HTTP.user:42":  13,
+		"connections.type:HTTP.user:12":  11,
+		"connections.type:HTTPS.user:42": 2,
+	}
+	if len(e) != len(expected) {
+		t.Errorf("expected %v stats, got %v", len(expected), e)
+	}
+	for name, v := range expected {
+		if e[name] != v {
+			t.Errorf("%v: expected %v, got %v", name, v, e[name])
+		}
+	}
+}
+
+func Test_ExpandingSegmentsDiscardsMismatchedKeys(t *testing.T) {
+	s := StatSegmented{
+		Name:       "connections",
+		Dimensions: []string{"type"},
+		Segments:   []Segment{{[]string{"HTTP", "42"}, 13}},
+	}
+	if e := s.Expand(); len(e) != 0 {
+		t.Errorf("expected no stats, got %v", e)
+	}
+}
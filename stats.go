@@ -3,15 +3,20 @@ package main
 type Count float64
 
 type DistMap map[string]*Dist
+type HistogramMap map[string]*Histogram
 type CounterMap map[string]float64
 type TypeMap map[string]*string
+type SegmentMap map[string][]string
 
 type TimestampedStats struct {
-	Timestamp int64
-	Dists     DistMap
-	Counters  CounterMap
-	Types     TypeMap
-	Empty     bool
+	Timestamp  int64
+	Dists      DistMap
+	Histograms HistogramMap
+	Counters   CounterMap
+	Types      TypeMap
+	Segments   SegmentMap // dimensions of each segmented stat, by name
+	Empty      bool
+	Requested  []string `json:",omitempty"` // set when only some stats were surveyed
 }
 
 var TypeCache TypeMap
@@ -22,25 +27,56 @@ func init() {
 
 func NewTimestampedStats(ts int64) *TimestampedStats {
 	return &TimestampedStats{
-		ts,
-		DistMap{},
-		CounterMap{},
-		TypeMap{},
-		true,
+		Timestamp:  ts,
+		Dists:      DistMap{},
+		Histograms: HistogramMap{},
+		Counters:   CounterMap{},
+		Types:      TypeMap{},
+		Segments:   SegmentMap{},
+		Empty:      true,
 	}
 }
 
 func NewTimestampedStatsWithTypes(ts int64) *TimestampedStats {
-	return &TimestampedStats{
-		ts,
-		DistMap{},
-		CounterMap{},
-		TypeCache,
-		true,
+	stats := NewTimestampedStats(ts)
+	stats.Types = TypeCache
+	return stats
+}
+
+// Merge adds already aggregated stats, e.g. to roll several intervals up
+// into one. Dists and histograms are copied rather than shared.
+func (self *TimestampedStats) Merge(other *TimestampedStats) {
+	if other.Empty {
+		return
+	}
+	self.Empty = false
+	for key, value := range other.Counters {
+		self.Counters[key] += value
+	}
+	for key, value := range other.Dists {
+		if d, ok := self.Dists[key]; ok {
+			d.Add(value)
+		} else {
+			copied := *value
+			self.Dists[key] = &copied
+		}
+	}
+	for key, value := range other.Histograms {
+		if h, ok := self.Histograms[key]; ok {
+			h.Add(value)
+		} else {
+			self.Histograms[key], _ = NewHistogram(value.Bounds, value.Counts)
+		}
+	}
+	for key, value := range other.Types {
+		self.Types[key] = value
+	}
+	for key, value := range other.Segments {
+		self.Segments[key] = value
 	}
 }
 
-func (self TimestampedStats) AddCount(s StatCount) {
+func (self *TimestampedStats) AddCount(s StatCount) {
 	self.Empty = false
 	self.Counters[s.Name] += s.Count
 	if s.Type != nil {
@@ -49,12 +85,19 @@ func (self TimestampedStats) AddCount(s StatCount) {
 	}
 }
 
-func (self TimestampedStats) AddValue(s StatValue) {
+func (self *TimestampedStats) AddValue(s StatValue) {
+	w := s.Weight
+	if w == 0 {
+		w = 1
+	} else if w < 0 {
+		info.Printf("[stats] Discarding value %v with negative weight %v", s.Name, w)
+		return
+	}
 	self.Empty = false
 	if d, ok := self.Dists[s.Name]; ok {
-		d.AddEntry(s.Value)
+		d.AddEntry(s.Value, w)
 	} else {
-		self.Dists[s.Name] = NewDistFromValue(s.Value)
+		self.Dists[s.Name] = NewDistFromValue(s.Value, w)
 	}
 	if s.Type != nil {
 		self.Types[s.Name] = s.Type
@@ -62,7 +105,7 @@ func (self TimestampedStats) AddValue(s StatValue) {
 	}
 }
 
-func (self TimestampedStats) AddDist(s StatDist) {
+func (self *TimestampedStats) AddDist(s StatDist) {
 	self.Empty = false
 	dist := ContstructDist(s.Dist)
 	if d, ok := self.Dists[s.Name]; ok {
@@ -76,18 +119,55 @@ func (self TimestampedStats) AddDist(s StatDist) {
 	}
 }
 
+func (self *TimestampedStats) AddHistogram(s StatHistogram) {
+	h, err := NewHistogram(s.Bounds, s.Counts)
+	if err != nil {
+		info.Printf("[stats] Discarding histogram %v: %v", s.Name, err)
+		return
+	}
+	self.Empty = false
+	if existing, ok := self.Histograms[s.Name]; ok {
+		existing.Add(h)
+	} else {
+		self.Histograms[s.Name] = h
+	}
+	if s.Type != nil {
+		self.Types[s.Name] = s.Type
+		TypeCache[s.Name] = s.Type
+	}
+}
+
+func (self *TimestampedStats) AddSegmentedValue(s StatSegmented) {
+	for name, v := range s.Expand() {
+		self.AddValue(StatValue{Name: name, Value: v, Type: s.Type})
+	}
+	self.Segments[s.Name] = s.Dimensions
+}
+
+func (self *TimestampedStats) AddSegmentedCount(s StatSegmented) {
+	for name, v := range s.Expand() {
+		self.AddCount(StatCount{name, v, s.Type})
+	}
+	self.Segments[s.Name] = s.Dimensions
+}
+
 type Stats struct {
-	Timestamp int64
-	Values    []StatValue
-	Counts    []StatCount
-	Dists     []StatDist
+	Timestamp       int64
+	Values          []StatValue
+	Counts          []StatCount
+	Dists           []StatDist
+	Histograms      []StatHistogram
+	SegmentedValues []StatSegmented
+	SegmentedCounts []StatSegmented
 }
 
-// TODO: Needs weight
+// A single value, which may stand in for several samples (e.g. when sampled).
+// A missing (zero) weight counts as 1.
 type StatValue struct {
-	Name  string
-	Value float64
-	Type  *string
+	Name   string
+	Value  float64
+	Weight float64
+	Type   *string
 }
 
 type StatCount struct {
@@ -101,3 +181,24 @@ type StatDist struct {
 	Dist [5]float64
 	Type *string
 }
+
+type StatHistogram struct {
+	Name   string
+	Bounds []float64
+	Counts []float64
+	Type   *string
+}
+
+// A stat broken down by one or more dimensions, e.g. connections by type and
+// user. Each segment has one key per dimension.
+type StatSegmented struct {
+	Name       string
+	Dimensions []string
+	Segments   []Segment
+	Type       *string
+}
+
+type Segment struct {
+	Keys  []string
+	Value float64
+}
@@ -0,0 +1,127 @@
+// Listens for StatsD metrics over UDP or a unixgram socket and pushes them into the interval currently being aggregated, alongside surveyed stats.
+//
+// Supported types are counters (`name:1|c`), timers (`name:12|ms` or `|h`) and gauges (`name:5|g`). Counters are scaled up by their sample rate (`name:1|c|@0.1` counts as 10), and sampled timers are weighted accordingly. Gauges are aggregated as values, so relative gauges (`+5`) are treated as absolute. Sets are not supported.
+
+package main
+
+import (
+	"fmt"
+	"math"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+)
+
+type StatsD struct {
+	addr string
+	push chan<- (*Stats)
+}
+
+func NewStatsD(addr string, push chan<- (*Stats)) *StatsD {
+	return &StatsD{addr, push}
+}
+
+// statsdNetwork maps udp:// and unixgram:// addresses to a net network. Bare
+// addresses are udp
+func statsdNetwork(addr string) (network, address string) {
+	if strings.HasPrefix(addr, "unixgram://") {
+		return "unixgram", strings.TrimPrefix(addr, "unixgram://")
+	}
+	return "udp", strings.TrimPrefix(addr, "udp://")
+}
+
+func (s *StatsD) Run() {
+	network, address := statsdNetwork(s.addr)
+	if network == "unixgram" {
+		// Remove a socket left behind by a previous run
+		os.Remove(address)
+	}
+	conn, err := net.ListenPacket(network, address)
+	if err != nil {
+		info.Printf("[statsd] Error listening on %v: %v", s.addr, err)
+		return
+	}
+	info.Printf("[statsd] Listening on %v", s.addr)
+
+	buf := make([]byte, 65536)
+	for {
+		n, _, err := conn.ReadFrom(buf)
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				info.Printf("[statsd] Error reading: %v", err)
+				continue
+			}
+			info.Printf("[statsd] Error reading, no longer listening: %v", err)
+			return
+		}
+		if stats := ParseStatsD(string(buf[:n])); stats != nil {
+			s.push <- stats
+		}
+	}
+}
+
+// ParseStatsD parses a packet of newline separated StatsD metrics. Invalid
+// lines are logged and skipped. Returns nil if no metrics were parsed.
+func ParseStatsD(packet string) *Stats {
+	stats := &Stats{}
+	for _, line := range strings.Split(packet, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		if err := parseStatsDLine(line, stats); err != nil {
+			debug.Printf("[statsd] Invalid metric %q: %v", line, err)
+		}
+	}
+	if len(stats.Values) == 0 && len(stats.Counts) == 0 {
+		return nil
+	}
+	return stats
+}
+
+func parseStatsDLine(line string, stats *Stats) error {
+	// Split off the type, rate and tags first, since DogStatsD tags (|#k:v)
+	// contain colons. Names may too (e.g. segments), so use the last colon
+	pipe := strings.Index(line, "|")
+	if pipe < 0 {
+		return fmt.Errorf("missing type")
+	}
+	colon := strings.LastIndex(line[:pipe], ":")
+	if colon < 1 {
+		return fmt.Errorf("missing name")
+	}
+	name := line[:colon]
+	fields := strings.Split(line[colon+1:], "|")
+
+	value, err := strconv.ParseFloat(fields[0], 64)
+	if err != nil {
+		return err
+	}
+	if math.IsNaN(value) || math.IsInf(value, 0) {
+		return fmt.Errorf("invalid value %v", fields[0])
+	}
+
+	rate := 1.0
+	for _, f := range fields[2:] {
+		if strings.HasPrefix(f, "@") {
+			if rate, err = strconv.ParseFloat(f[1:], 64); err != nil || rate <= 0 || rate > 1 {
+				return fmt.Errorf("invalid sample rate %v", f)
+			}
+		}
+	}
+
+	switch fields[1] {
+	case "c":
+		t := "count"
+		stats.Counts = append(stats.Counts, StatCount{name, value / rate, &t})
+	case "ms", "h":
+		t := "ms"
+		stats.Values = append(stats.Values, StatValue{Name: name, Value: value, Weight: 1 / rate, Type: &t})
+	case "g":
+		stats.Values = append(stats.Values, StatValue{Name: name, Value: value})
+	default:
+		return fmt.Errorf("unsupported type %v", fields[1])
+	}
+	return nil
+}
@@ -0,0 +1,44 @@
+package main
+
+import "testing"
+
+func Test_ParsingStatsD(t *testing.T) {
+	stats := ParseStatsD("hits:1|c\nhits:2|c|@0.5\nlatency:12|ms|@0.1\nqueue:5|g\n")
+	if stats == nil {
+		t.Fatal("expected stats")
+	}
+	if len(stats.Counts) != 2 || stats.Counts[0].Count != 1 || stats.Counts[1].Count != 4 {
+		t.Errorf("counts: %v", stats.Counts)
+	}
+	if len(stats.Values) != 2 {
+		t.Fatalf("values: %v", stats.Values)
+	}
+	if v := stats.Values[0]; v.Name != "latency" || v.Value != 12 || v.Weight != 10 || *v.Type != "ms" {
+		t.Errorf("timer: %v", v)
+	}
+	if v := stats.Values[1]; v.Name != "queue" || v.Value != 5 || v.Weight != 0 {
+		t.Errorf("gauge: %v", v)
+	}
+}
+
+func Test_ParsingStatsDTags(t *testing.T) {
+	stats := ParseStatsD("hits:3|c|#env:prod,host:web1\nconns.host:web1:7|g|#env:prod")
+	if stats == nil || len(stats.Counts) != 1 || len(stats.Values) != 1 {
+		t.Fatalf("expected a count and a value, got %v", stats)
+	}
+	if c := stats.Counts[0]; c.Name != "hits" || c.Count != 3 {
+		t.Errorf("count: %v", c)
+	}
+	if v := stats.Values[0]; v.Name != "conns.host:web1" || v.Value != 7 {
+		t.Errorf("gauge: %v", v)
+	}
+}
+
+func Test_ParsingInvalidStatsD(t *testing.T) {
+	for _, p := range []string{"", "hits", "hits:1", "hits:x|c", "users:1|s", "hits:1|c|@2",
+		"hits:NaN|c", "load:Inf|g", "load:-inf|g", "latency:infinity|ms"} {
+		if stats := ParseStatsD(p); stats != nil {
+			t.Errorf("expected nothing for %q, got %v", p, stats)
+		}
+	}
+}
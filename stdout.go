@@ -22,6 +22,9 @@ func (self *StdOut) Send(stats *TimestampedStats) {
 	for key, value := range stats.Dists {
 		output = append(output, fmt.Sprintf("%v: %v\n", key, value))
 	}
+	for key, value := range stats.Histograms {
+		output = append(output, fmt.Sprintf("%v: %v\n", key, value))
+	}
 	sort.Strings(output)
 	log.Print(heading, output)
 }
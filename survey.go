@@ -0,0 +1,71 @@
+// A survey schedule decides which stats are requested from clients on each tick. Cheap stats may be requested on every tick, while expensive stats can be requested less often by listing them under a larger period.
+//
+// Schedules are written as `period:stat,stat;period:*`, where period is a number of ticks and `*` requests all stats (report_all). For example `1:connections,messages;6:*` requests connections and messages on every tick and everything on every 6th tick. The default (empty) schedule requests all stats on every tick.
+
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+type SurveyEntry struct {
+	Every int
+	Stats []string // nil means all stats
+}
+
+type SurveySchedule []SurveyEntry
+
+func ParseSurveySchedule(s string) (SurveySchedule, error) {
+	schedule := SurveySchedule{}
+	if s == "" {
+		return append(schedule, SurveyEntry{1, nil}), nil
+	}
+	for _, part := range strings.Split(s, ";") {
+		fields := strings.SplitN(part, ":", 2)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("invalid survey entry %q, expected period:stats", part)
+		}
+		every, err := strconv.Atoi(fields[0])
+		if err != nil || every < 1 {
+			return nil, fmt.Errorf("invalid survey period %q", fields[0])
+		}
+		entry := SurveyEntry{Every: every}
+		if fields[1] != "*" {
+			for _, name := range strings.Split(fields[1], ",") {
+				if name != "" {
+					entry.Stats = append(entry.Stats, name)
+				}
+			}
+			if len(entry.Stats) == 0 {
+				return nil, fmt.Errorf("survey entry %q lists no stats", part)
+			}
+		}
+		schedule = append(schedule, entry)
+	}
+	return schedule, nil
+}
+
+// Due returns whether any stats should be requested on the nth tick, and if so which ones. A nil list means that all stats should be requested.
+func (self SurveySchedule) Due(n int) (due bool, stats []string) {
+	names := map[string]bool{}
+	for _, e := range self {
+		if n%e.Every != 0 {
+			continue
+		}
+		if e.Stats == nil {
+			return true, nil
+		}
+		due = true
+		for _, name := range e.Stats {
+			names[name] = true
+		}
+	}
+	for name := range names {
+		stats = append(stats, name)
+	}
+	sort.Strings(stats)
+	return
+}
@@ -0,0 +1,44 @@
+package main
+
+import "testing"
+
+func Test_DefaultScheduleRequestsAll(t *testing.T) {
+	s, err := ParseSurveySchedule("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if due, stats := s.Due(3); !due || stats != nil {
+		t.Fail()
+	}
+}
+
+func Test_ScheduleRequestsListedStats(t *testing.T) {
+	s, err := ParseSurveySchedule("1:b,a;2:c;6:*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if due, stats := s.Due(1); !due || len(stats) != 2 || stats[0] != "a" || stats[1] != "b" {
+		t.Errorf("tick 1: %v", stats)
+	}
+	if due, stats := s.Due(2); !due || len(stats) != 3 {
+		t.Errorf("tick 2: %v", stats)
+	}
+	if due, stats := s.Due(6); !due || stats != nil {
+		t.Errorf("tick 6: %v", stats)
+	}
+}
+
+func Test_ScheduleNotDue(t *testing.T) {
+	s, _ := ParseSurveySchedule("2:a")
+	if due, _ := s.Due(1); due {
+		t.Fail()
+	}
+}
+
+func Test_InvalidSchedule(t *testing.T) {
+	for _, s := range []string{"a", "0:a", "x:a", "1:"} {
+		if _, err := ParseSurveySchedule(s); err == nil {
+			t.Errorf("expected error for %q", s)
+		}
+	}
+}
@@ -2,21 +2,36 @@ package main
 
 import "time"
 
-// Like a time.Tick, but anchored at time modulo boundary
-func NewTicker(interval int) <-chan (time.Time) {
+// Like a time.Tick, but anchored at time modulo boundary. Closing stop stops
+// the ticker
+func NewTicker(interval int, stop <-chan bool) <-chan (time.Time) {
 
 	period := time.Duration(interval) * time.Second
 	ticks := make(chan time.Time)
 	go func() {
 		// Wait till the end of the current period
 		elapsed := time.Now().UnixNano() % period.Nanoseconds()
-		now := <-time.After(time.Duration(period.Nanoseconds() - elapsed))
+		var now time.Time
+		select {
+		case now = <-time.After(time.Duration(period.Nanoseconds() - elapsed)):
+		case <-stop:
+			return
+		}
 
 		// Use Ticker to tick regularly
-		tick_chan := time.Tick(period)
-		ticks <- now
+		tick := time.NewTicker(period)
+		defer tick.Stop()
 		for {
-			ticks <- <-tick_chan
+			select {
+			case ticks <- now:
+			case <-stop:
+				return
+			}
+			select {
+			case now = <-tick.C:
+			case <-stop:
+				return
+			}
 		}
 	}()
 	return ticks
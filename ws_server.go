@@ -15,10 +15,17 @@ import (
 type Websocketsender struct {
 	mutex       sync.Mutex
 	connections map[*websocket.Conn]*sync.Cond
+	// The last stats sent, replayed to new connections (oldest first)
+	backlog     []*TimestampedStats
+	backlogSize int
+	stopped     bool // set by Stop, after which connections aren't registered
 }
 
-func NewWebsocketsender() *Websocketsender {
-	return &Websocketsender{connections: make(map[*websocket.Conn]*sync.Cond)}
+func NewWebsocketsender(backlogSize int) *Websocketsender {
+	return &Websocketsender{
+		connections: make(map[*websocket.Conn]*sync.Cond),
+		backlogSize: backlogSize,
+	}
 }
 
 func (s *Websocketsender) GetWebsocketSenderHandler() websocket.Handler {
@@ -31,30 +38,94 @@ func (s *Websocketsender) GetWebsocketSenderHandler() websocket.Handler {
 			s.mutex.Unlock()
 			log.Println("Web socket closed. Total connections", len(s.connections))
 		}()
-		s.mutex.Lock()
-		s.connections[ws] = sync.NewCond(&sync.Mutex{})
-		s.connections[ws].L.Lock()
-		s.mutex.Unlock()
+		ws.SetWriteDeadline(time.Now().Add(300 * time.Millisecond))
 		if b, err := json.Marshal(NewTimestampedStatsWithTypes(-1)); err == nil {
 			err := websocket.Message.Send(ws, string(b))
 			if err != nil {
 				log.Println("Web socket: Cannot deliver initial message")
 			}
 		}
+
+		// Send the backlog before registering the connection, so that it
+		// arrives before (and isn't interleaved with) new stats. It's written
+		// without holding the mutex so that a slow connection doesn't hold up
+		// Send, then any stats sent meanwhile are caught up on
+		var sent int64 = -1
+		s.mutex.Lock()
+		for {
+			var pending []*TimestampedStats
+			for _, stats := range s.backlog {
+				if stats.Timestamp > sent {
+					pending = append(pending, stats)
+				}
+			}
+			if len(pending) == 0 {
+				break
+			}
+			s.mutex.Unlock()
+			for _, stats := range pending {
+				if b, err := json.Marshal(stats); err == nil {
+					ws.SetWriteDeadline(time.Now().Add(300 * time.Millisecond))
+					if err := websocket.Message.Send(ws, string(b)); err != nil {
+						log.Println("Web socket: Cannot deliver backlog")
+						return
+					}
+				}
+				sent = stats.Timestamp
+			}
+			s.mutex.Lock()
+		}
+		if s.stopped {
+			// Handled through a mux which has since been replaced
+			s.mutex.Unlock()
+			return
+		}
+		ws.SetWriteDeadline(time.Time{})
+		// Signalled with cond.L held, so held here until Wait to ensure that
+		// a signal isn't missed
+		cond := sync.NewCond(&sync.Mutex{})
+		cond.L.Lock()
+		s.connections[ws] = cond
+		s.mutex.Unlock()
 		log.Println("Web socket connected:", ws.RemoteAddr(), "Total connections", len(s.connections))
-		s.connections[ws].Wait()
+		cond.Wait()
 	}
 	return websocket.Handler(handlerf)
 }
 
+// Stop disconnects all websocket connections, and any connecting afterwards
+func (s *Websocketsender) Stop() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.stopped = true
+	for _, cond := range s.connections {
+		disconnect(cond)
+	}
+}
+
+// disconnect wakes a connection's handler, which then closes it
+func disconnect(cond *sync.Cond) {
+	cond.L.Lock()
+	cond.Signal()
+	cond.L.Unlock()
+}
+
 func (s *Websocketsender) Send(stats *TimestampedStats) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.backlogSize > 0 {
+		s.backlog = append(s.backlog, stats)
+		if len(s.backlog) > s.backlogSize {
+			s.backlog = s.backlog[len(s.backlog)-s.backlogSize:]
+		}
+	}
 	for ws, cond := range s.connections {
 		if b, err := json.Marshal(stats); err == nil {
 			ws.SetWriteDeadline(time.Now().Add(300 * time.Millisecond))
 			err := websocket.Message.Send(ws, string(b))
 			if err != nil {
 				log.Println("Web socket: Cannot deliver msg")
-				cond.Signal()
+				disconnect(cond)
 			}
 		}
 	}
@@ -0,0 +1,63 @@
+// Publishes aggregated data on a ZMQ PUB socket, for downstream stagger processes (see Relay) and any other process which wishes to subscribe.
+//
+// Each stat is published as two frames: the stat name (so subscribers can filter by prefix) and a msgpack PubEnvelope, whose Kind is counter, dist or histogram. Once every stat for a timestamp has been published, an envelope of Kind end is published with the name stagger:end, so subscribers know the interval is complete.
+
+package main
+
+import (
+	zmq "github.com/pebbe/zmq4"
+)
+
+const pubEndTopic = "stagger:end"
+
+type PubEnvelope struct {
+	Kind      string
+	Timestamp int64
+	Type      *string    `codec:",omitempty"`
+	Count     float64    `codec:",omitempty"`
+	Dist      *Dist      `codec:",omitempty"`
+	Histogram *Histogram `codec:",omitempty"`
+}
+
+type ZmqPub struct {
+	pub *zmq.Socket
+}
+
+func NewZmqPub(addr string) (*ZmqPub, error) {
+	pub, err := zmq.NewSocket(zmq.PUB)
+	if err != nil {
+		return nil, err
+	}
+	if err := pub.Bind(addr); err != nil {
+		pub.Close()
+		return nil, err
+	}
+	return &ZmqPub{pub}, nil
+}
+
+func (z *ZmqPub) publish(topic string, e PubEnvelope) {
+	if b, err := marshal(e); err == nil {
+		z.pub.Send(topic, zmq.SNDMORE)
+		z.pub.SendBytes(b, 0)
+	} else {
+		info.Printf("[zmq-pub] Error encoding as msgpack: %v", e)
+	}
+}
+
+func (z *ZmqPub) Send(stats *TimestampedStats) {
+	for key, value := range stats.Counters {
+		z.publish(key, PubEnvelope{Kind: "counter", Timestamp: stats.Timestamp, Type: stats.Types[key], Count: value})
+	}
+	for key, value := range stats.Dists {
+		z.publish(key, PubEnvelope{Kind: "dist", Timestamp: stats.Timestamp, Type: stats.Types[key], Dist: value})
+	}
+	for key, value := range stats.Histograms {
+		z.publish(key, PubEnvelope{Kind: "histogram", Timestamp: stats.Timestamp, Type: stats.Types[key], Histogram: value})
+	}
+	z.publish(pubEndTopic, PubEnvelope{Kind: "end", Timestamp: stats.Timestamp})
+}
+
+// Stop closes the socket. Send must not be called afterwards
+func (z *ZmqPub) Stop() {
+	z.pub.Close()
+}